@@ -0,0 +1,720 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BankAccount struct {
+	Id           int
+	Balance      int
+	Version      int // bumped on every change, served as the ETag
+	Transactions []Transaction
+}
+
+// Transaction is one entry of an account's ledger.
+type Transaction struct {
+	Kind      string // "deposit", "withdrawal", "transfer in" or "transfer out"
+	Amount    int
+	CreatedAt time.Time
+	Actor     string
+	Balance   int // balance after the transaction
+
+	Counterparty int `json:",omitempty"` // the other account of a transfer
+}
+
+const (
+	ledgerPageSize = 10
+	maxAmount      = 1_000_000
+)
+
+var (
+	errAccountNotFound = errors.New("account not found")
+	errOverdraft       = errors.New("insufficient funds")
+	errAccountNotEmpty = errors.New("account still holds money")
+	errVersionMismatch = errors.New("account was changed in the meantime")
+)
+
+// anyVersion matches every version, like If-Match: *
+const anyVersion = -1
+
+// ETag is the HTML representation's.
+func (a BankAccount) ETag() string {
+	return a.etagFor(mediaTypeHTML)
+}
+
+// etagFor tags each representation differently, or a cache holding the
+// HTML could answer a HAL request with it. The version comes first.
+func (a BankAccount) etagFor(mediaType string) string {
+	tag := strconv.Itoa(a.Version)
+	switch mediaType {
+	case mediaTypeHAL:
+		tag += "-hal"
+	case mediaTypeJSONAPI:
+		tag += "-jsonapi"
+	}
+	return `"` + tag + `"`
+}
+
+func (a *BankAccount) checkVersion(version int) error {
+	if version != anyVersion && version != a.Version {
+		return errVersionMismatch
+	}
+	return nil
+}
+
+// apply books a transaction, refusing withdrawals that would overdraw the account.
+func (a *BankAccount) apply(kind string, amount int, actor string) error {
+	switch kind {
+	case "deposit":
+		a.Balance += amount
+	case "withdrawal":
+		if amount > a.Balance {
+			return errOverdraft
+		}
+		a.Balance -= amount
+	default:
+		return fmt.Errorf("unknown transaction kind %q", kind)
+	}
+	a.Transactions = append(a.Transactions, Transaction{
+		Kind:      kind,
+		Amount:    amount,
+		CreatedAt: time.Now(),
+		Actor:     actor,
+		Balance:   a.Balance,
+	})
+	return nil
+}
+
+// AccountStore holds all bank accounts. Each account has its own mutex, so
+// requests on different accounts don't wait for each other, and every
+// mutation is written to a JSON file, so balances survive pod restarts when
+// ./nfs is a mounted volume.
+//
+// Lock order: s.mu before any account's mu, and account mus by ascending id.
+// Nothing holding an account's mu may take s.mu.
+type AccountStore struct {
+	mu       sync.RWMutex // guards accounts and nextId
+	accounts map[int]*accountEntry
+	nextId   int
+
+	path     string
+	saveMu   sync.Mutex
+	noLedger bool // skip ledger entries, for throwaway stress test stores
+}
+
+type accountEntry struct {
+	mu sync.Mutex
+	BankAccount
+	// set by Close under mu: a caller that got the entry before it was
+	// removed must not change it, nothing would ever save that
+	closed bool
+}
+
+func NewAccountStore(path string) (*AccountStore, error) {
+	s := &AccountStore{
+		accounts: map[int]*accountEntry{},
+		nextId:   10000,
+		path:     path,
+	}
+	if path == "" {
+		return s, nil
+	}
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var accounts []BankAccount
+	if err := json.Unmarshal(contents, &accounts); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, a := range accounts {
+		s.accounts[a.Id] = &accountEntry{BankAccount: a}
+		s.nextId = max(s.nextId, a.Id+1)
+	}
+	return s, nil
+}
+
+// save writes all accounts to disk. A failed write is only logged, the
+// in-memory state stays authoritative. Caller must not hold any account's mu.
+func (s *AccountStore) save() {
+	if s.path == "" {
+		return
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if err := s.write(s.List()); err != nil {
+		fmt.Println("couldn't persist accounts to", s.path, "err:", err)
+	}
+}
+
+func (s *AccountStore) write(accounts []BankAccount) error {
+	contents, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write and rename, so a crash never leaves a half written file
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, contents, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *AccountStore) entry(id int) (*accountEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.accounts[id]
+	if !ok {
+		return nil, errAccountNotFound
+	}
+	return e, nil
+}
+
+func (s *AccountStore) Get(id int) (BankAccount, error) {
+	e, err := s.entry(id)
+	if err != nil {
+		return BankAccount{}, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return BankAccount{}, errAccountNotFound
+	}
+	return e.clone(), nil
+}
+
+// clone copies the account, so callers never share the ledger with the store.
+func (a *BankAccount) clone() BankAccount {
+	c := *a
+	c.Transactions = slices.Clone(a.Transactions)
+	return c
+}
+
+func (s *AccountStore) List() []BankAccount {
+	s.mu.RLock()
+	entries := make([]*accountEntry, 0, len(s.accounts))
+	for _, e := range s.accounts {
+		entries = append(entries, e)
+	}
+	s.mu.RUnlock()
+
+	accounts := make([]BankAccount, 0, len(entries))
+	for _, e := range entries {
+		e.mu.Lock()
+		if !e.closed {
+			accounts = append(accounts, e.clone())
+		}
+		e.mu.Unlock()
+	}
+	slices.SortFunc(accounts, func(a, b BankAccount) int { return a.Id - b.Id })
+	return accounts
+}
+
+// Create opens a new account. id 0 picks the next free one.
+func (s *AccountStore) Create(id, balance int) (BankAccount, error) {
+	s.mu.Lock()
+	if id == 0 {
+		id = s.nextId
+	}
+	if _, ok := s.accounts[id]; ok {
+		s.mu.Unlock()
+		return BankAccount{}, fmt.Errorf("account %d already exists", id)
+	}
+	a := BankAccount{Id: id, Balance: balance, Version: 1}
+	s.accounts[id] = &accountEntry{BankAccount: a}
+	s.nextId = max(s.nextId, id+1)
+	s.mu.Unlock()
+
+	s.save()
+	return a, nil
+}
+
+// Update applies fn to the account under its lock, bumps its version and
+// persists the result. If fn returns an error nothing is changed.
+func (s *AccountStore) Update(id int, fn func(a *BankAccount) error) (BankAccount, error) {
+	e, err := s.entry(id)
+	if err != nil {
+		return BankAccount{}, err
+	}
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return BankAccount{}, errAccountNotFound
+	}
+	updated := e.clone()
+	if err := fn(&updated); err != nil {
+		current := e.clone()
+		e.mu.Unlock()
+		return current, err
+	}
+	updated.Version++
+	e.BankAccount = updated
+	e.mu.Unlock()
+
+	s.save()
+	return updated, nil
+}
+
+// Transfer moves amount between two accounts. Both locks are taken in order
+// of the account id, so two opposite transfers can't deadlock waiting on each
+// other. With unsafe set the very same code runs without any locks, which
+// loses updates under concurrency. fromVersion must match the source account's
+// version, or be anyVersion.
+func (s *AccountStore) Transfer(fromId, toId, amount, fromVersion int, actor string, unsafe bool) (BankAccount, error) {
+	if fromId == toId {
+		return BankAccount{}, fmt.Errorf("can't transfer to the same account")
+	}
+	from, err := s.entry(fromId)
+	if err != nil {
+		return BankAccount{}, err
+	}
+	to, err := s.entry(toId)
+	if err != nil {
+		return BankAccount{}, err
+	}
+
+	if !unsafe {
+		first, second := from, to
+		if toId < fromId {
+			first, second = to, from
+		}
+		first.mu.Lock()
+		second.mu.Lock()
+	}
+
+	fromBalance, toBalance := from.Balance, to.Balance
+	if from.closed || to.closed {
+		err = errAccountNotFound
+	} else {
+		err = from.checkVersion(fromVersion)
+	}
+	if err == nil && amount > fromBalance {
+		err = errOverdraft
+	}
+	if err != nil {
+		result := from.clone()
+		if !unsafe {
+			from.mu.Unlock()
+			to.mu.Unlock()
+		}
+		return result, err
+	}
+	// give other goroutines a chance to interleave between read and write,
+	// so without locks the lost updates show up even on a single CPU
+	runtime.Gosched()
+	from.Balance = fromBalance - amount
+	to.Balance = toBalance + amount
+	from.Version++
+	to.Version++
+
+	if !s.noLedger {
+		now := time.Now()
+		from.Transactions = append(from.Transactions, Transaction{
+			Kind: "transfer out", Amount: amount, CreatedAt: now, Actor: actor, Balance: from.Balance, Counterparty: toId,
+		})
+		to.Transactions = append(to.Transactions, Transaction{
+			Kind: "transfer in", Amount: amount, CreatedAt: now, Actor: actor, Balance: to.Balance, Counterparty: fromId,
+		})
+	}
+	result := from.clone()
+	if !unsafe {
+		from.mu.Unlock()
+		to.mu.Unlock()
+	}
+
+	s.save()
+	return result, nil
+}
+
+// Total sums all balances, which transfers must never change.
+func (s *AccountStore) Total() int {
+	total := 0
+	for _, a := range s.List() {
+		total += a.Balance
+	}
+	return total
+}
+
+var accounts *AccountStore
+
+// Close removes an account, which is only allowed once it's empty and at the
+// given version.
+func (s *AccountStore) Close(id, version int) error {
+	s.mu.Lock()
+	e, ok := s.accounts[id]
+	if !ok {
+		s.mu.Unlock()
+		return errAccountNotFound
+	}
+	e.mu.Lock()
+	err := e.checkVersion(version)
+	if err == nil && e.Balance != 0 {
+		err = errAccountNotEmpty
+	}
+	if err != nil {
+		e.mu.Unlock()
+		s.mu.Unlock()
+		return err
+	}
+	delete(s.accounts, id)
+	e.closed = true
+	e.mu.Unlock()
+	s.mu.Unlock()
+
+	s.save()
+	return nil
+}
+
+// accountFromRequest looks up the {id} path value, answering 404 itself.
+func accountFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return 0, false
+	}
+	if _, err := accounts.Get(id); err != nil {
+		http.NotFound(w, r)
+		return 0, false
+	}
+	return id, true
+}
+
+// Link is a hypermedia control. Which links an account has depends on its
+// state, both the HTML page and the JSON representations render from these.
+type Link struct {
+	Href   string `json:"href"`
+	Method string `json:"method,omitempty"`
+	Title  string `json:"title,omitempty"`
+}
+
+func accountLinks(a BankAccount) map[string]Link {
+	self := fmt.Sprintf("/account/%d", a.Id)
+	links := map[string]Link{
+		"self":       {Href: self, Method: http.MethodGet},
+		"collection": {Href: "/account", Method: http.MethodGet, Title: "all accounts"},
+		"deposits":   {Href: self + "/deposits", Method: http.MethodPost, Title: "deposit"},
+	}
+	// nothing to withdraw from an empty account, and only an empty one can be closed
+	if a.Balance > 0 {
+		links["withdrawal"] = Link{Href: self + "/withdrawal", Method: http.MethodPost, Title: "withdraw"}
+		links["transfer"] = Link{Href: "/transfer", Method: http.MethodPost, Title: "transfer"}
+	} else {
+		links["close"] = Link{Href: self + "/close", Method: http.MethodPost, Title: "close account"}
+	}
+	return links
+}
+
+type AccountView struct {
+	BankAccount
+	Links    map[string]Link
+	Ledger   []Transaction // the current page, newest first
+	Page     int
+	Pages    int
+	PrevPage int
+	NextPage int
+	Stale    bool // the client tried to change an outdated version
+
+	CSRFToken string
+}
+
+func newAccountView(a BankAccount, page int) AccountView {
+	pages := max((len(a.Transactions)+ledgerPageSize-1)/ledgerPageSize, 1)
+	page = min(max(page, 1), pages)
+
+	// newest first
+	ledger := slices.Clone(a.Transactions)
+	slices.Reverse(ledger)
+	start := (page - 1) * ledgerPageSize
+	end := min(start+ledgerPageSize, len(ledger))
+
+	v := AccountView{BankAccount: a, Links: accountLinks(a), Ledger: ledger[start:end], Page: page, Pages: pages}
+	if page > 1 {
+		v.PrevPage = page - 1
+	}
+	if page < pages {
+		v.NextPage = page + 1
+	}
+	return v
+}
+
+// renderAccount serves the account as HTML, or as HAL or JSON:API when the
+// Accept header asks for it.
+func renderAccount(w http.ResponseWriter, r *http.Request, a BankAccount) {
+	renderAccountStatus(w, r, a, http.StatusOK)
+}
+
+// renderAccountStatus is renderAccount with a status code. A 412 renders the
+// current state with a notice that the client's copy was stale.
+func renderAccountStatus(w http.ResponseWriter, r *http.Request, a BankAccount, status int) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	view := newAccountView(a, page)
+	view.Stale = status == http.StatusPreconditionFailed
+
+	mediaType := negotiateAccountType(r.Header.Get("Accept"))
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("ETag", a.etagFor(mediaType))
+	switch mediaType {
+	case mediaTypeHAL:
+		writeAccountJSON(w, status, mediaTypeHAL, accountHAL(view))
+		return
+	case mediaTypeJSONAPI:
+		writeAccountJSON(w, status, mediaTypeJSONAPI, accountJSONAPI(view))
+		return
+	}
+
+	tmplPath := filepath.Join("templates", "account.html")
+	tmpl, err := template.ParseFiles(tmplPath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	view.CSRFToken = csrfToken(w, r)
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, view); err != nil {
+		http.Error(w, "render error:"+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ifMatchVersion reads the version a mutation expects from If-Match. Without
+// the header it answers 428 itself, lost updates are exactly what it prevents.
+func ifMatchVersion(w http.ResponseWriter, r *http.Request) (int, bool) {
+	etag := strings.TrimSpace(r.Header.Get("If-Match"))
+	if etag == "" {
+		http.Error(w, "If-Match header with the account's ETag required", http.StatusPreconditionRequired)
+		return 0, false
+	}
+	if etag == "*" {
+		return anyVersion, true
+	}
+	// If-Match compares strongly, a weak tag never matches
+	if strings.HasPrefix(etag, "W/") {
+		return -2, true
+	}
+	// any representation's tag will do, they all carry the version
+	version, _, _ := strings.Cut(strings.Trim(etag, `"`), "-")
+	n, err := strconv.Atoi(version)
+	if err != nil {
+		// can't match any of our ETags
+		return -2, true
+	}
+	return n, true
+}
+
+// noneMatch reports whether the If-None-Match header lists etag, comparing
+// weakly as RFC 9110 asks for it.
+func noneMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// actorFromRequest is the logged in user, who the ledger records.
+func actorFromRequest(r *http.Request) string {
+	if user, ok := currentUser(r); ok {
+		return user.DisplayName()
+	}
+	return "Anonymous"
+}
+
+// works
+func accountTest(w http.ResponseWriter, r *http.Request) {
+	a, err := accounts.Get(12345)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	str := fmt.Sprintf("<b>Account: %d Deposit: %d</b>", a.Id, a.Balance)
+	w.Write([]byte(str))
+}
+
+// accountsHandler lists all accounts and, on POST, creates a new one.
+func accountsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		balance, err := strconv.Atoi(r.FormValue("balance"))
+		if err != nil || balance < 0 {
+			http.Error(w, "balance must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		a, err := accounts.Create(0, balance)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/account/%d", a.Id), http.StatusSeeOther)
+		return
+	}
+
+	tmplPath := filepath.Join("templates", "accounts.html")
+	tmpl, err := template.ParseFiles(tmplPath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, struct {
+		Accounts  []BankAccount
+		CSRFToken string
+	}{accounts.List(), csrfToken(w, r)})
+}
+
+func account(w http.ResponseWriter, r *http.Request) {
+	id, ok := accountFromRequest(w, r)
+	if !ok {
+		return
+	}
+	a, _ := accounts.Get(id)
+	etag := a.etagFor(negotiateAccountType(r.Header.Get("Accept")))
+	if noneMatch(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Add("Vary", "Accept")
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	renderAccount(w, r, a)
+}
+
+// transact books a deposit or withdrawal of the form's amount. A withdrawal
+// that would overdraw the account is refused with 409 and a fragment explaining why.
+func transact(w http.ResponseWriter, r *http.Request, kind string) {
+	// link prefetchers and crawlers must not move money
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, ok := accountFromRequest(w, r)
+	if !ok {
+		return
+	}
+	amount, err := strconv.Atoi(r.FormValue("amount"))
+	if err != nil || amount < 1 || amount > maxAmount {
+		http.Error(w, fmt.Sprintf("amount must be between 1 and %d", maxAmount), http.StatusBadRequest)
+		return
+	}
+	version, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	a, err := accounts.Update(id, func(a *BankAccount) error {
+		if err := a.checkVersion(version); err != nil {
+			return err
+		}
+		return a.apply(kind, amount, actorFromRequest(r))
+	})
+	if errors.Is(err, errVersionMismatch) {
+		renderAccountStatus(w, r, a, http.StatusPreconditionFailed)
+		return
+	}
+	if errors.Is(err, errOverdraft) {
+		renderOverdraft(w, a, amount)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderAccount(w, r, a)
+}
+
+// renderOverdraft refuses with 409 and a fragment explaining why.
+func renderOverdraft(w http.ResponseWriter, a BankAccount, amount int) {
+	w.WriteHeader(http.StatusConflict)
+	tmplPath := filepath.Join("templates", "account-overdraft.html")
+	tmpl, err := template.ParseFiles(tmplPath)
+	if err != nil {
+		fmt.Fprintf(w, "template error: %s", err)
+		return
+	}
+	tmpl.Execute(w, struct {
+		BankAccount
+		Amount int
+	}{a, amount})
+}
+
+// Because this Handler returns HTML with embeded hypermedia control
+// this is a hypermedia API and the golang server a hypermedia server
+// and this API truely RESTful!
+func withdrawal(w http.ResponseWriter, r *http.Request) {
+	transact(w, r, "withdrawal")
+}
+
+func deposits(w http.ResponseWriter, r *http.Request) {
+	transact(w, r, "deposit")
+}
+
+// closeAccount deletes an empty account and sends the client back to the list.
+func closeAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, ok := accountFromRequest(w, r)
+	if !ok {
+		return
+	}
+	version, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
+	}
+	err := accounts.Close(id, version)
+	if errors.Is(err, errVersionMismatch) {
+		a, _ := accounts.Get(id)
+		renderAccountStatus(w, r, a, http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	// XHR follows a 303 on its own, htmx would only see the list page
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", "/account")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+func setupAccounts(mux *http.ServeMux) {
+	var err error
+	accounts, err = NewAccountStore(envOr("ACCOUNTS_FILE", filepath.Join("nfs", "accounts.json")))
+	if err != nil {
+		fmt.Println("couldn't load accounts, starting empty:", err)
+		accounts, _ = NewAccountStore("")
+	}
+	// the demo account the old hard-coded routes used
+	if _, err := accounts.Get(12345); err != nil {
+		accounts.Create(12345, 100)
+	}
+
+	mux.HandleFunc("/accountTest", accountTest)
+
+	mux.HandleFunc("/account", csrfProtect(accountsHandler))
+	// the frontends CORS_TRUSTED_ORIGINS lists can read the account API
+	mux.HandleFunc("/account/{id}", withCORS(accountCORS, account))
+	mux.HandleFunc("/account/{id}/deposits", csrfProtect(idempotent(deposits)))
+	mux.HandleFunc("/account/{id}/withdrawal", csrfProtect(idempotent(withdrawal)))
+	mux.HandleFunc("/account/{id}/close", csrfProtect(closeAccount))
+
+	mux.HandleFunc("/transfer", csrfProtect(idempotent(transferHandler)))
+	mux.HandleFunc("/transfer/stress", csrfProtect(transferStressHandler))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestTransferConservesMoney moves money between accounts, deposits into one
+// of them and closes it, all at once. No money may appear or vanish.
+func TestTransferConservesMoney(t *testing.T) {
+	const (
+		numAccounts = 5
+		balance     = 1000
+		closing     = numAccounts + 1 // starts empty, gets closed mid-run
+		workers     = 8
+		perWorker   = 500
+	)
+	store, _ := NewAccountStore("")
+	for i := range numAccounts {
+		store.Create(i+1, balance)
+	}
+	store.Create(closing, 0)
+
+	var deposited atomic.Int64
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for range perWorker {
+				from, to := rand.IntN(closing)+1, rand.IntN(closing)+1
+				if from != to {
+					store.Transfer(from, to, rand.IntN(10)+1, anyVersion, "test", false)
+				}
+				_, err := store.Update(closing, func(a *BankAccount) error {
+					a.Balance += 5
+					return nil
+				})
+				if err == nil {
+					deposited.Add(5)
+				} else if !errors.Is(err, errAccountNotFound) {
+					t.Errorf("deposit: %v", err)
+				}
+			}
+		})
+	}
+	// empty the account into account 1 and close it at that version,
+	// until nothing came in between
+	closed := false
+	for !closed {
+		a, err := store.Get(closing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Balance > 0 {
+			if a, err = store.Transfer(closing, 1, a.Balance, a.Version, "test", false); err != nil {
+				continue
+			}
+		}
+		closed = store.Close(closing, a.Version) == nil
+	}
+	wg.Wait()
+
+	if _, err := store.Get(closing); !errors.Is(err, errAccountNotFound) {
+		t.Errorf("closed account still found: %v", err)
+	}
+	want := numAccounts*balance + int(deposited.Load())
+	if got := store.Total(); got != want {
+		t.Errorf("total is %d, want %d: money appeared or vanished", got, want)
+	}
+}
+
+func TestTransferRefusesOverdraft(t *testing.T) {
+	store, _ := NewAccountStore("")
+	store.Create(1, 10)
+	store.Create(2, 0)
+	if _, err := store.Transfer(1, 2, 11, anyVersion, "test", false); !errors.Is(err, errOverdraft) {
+		t.Errorf("got %v, want errOverdraft", err)
+	}
+	if total := store.Total(); total != 10 {
+		t.Errorf("total is %d after a refused transfer, want 10", total)
+	}
+}
+
+// TestUpdateRacingClose lets a deposit find the account, then closes it
+// before the deposit gets the account's lock.
+func TestUpdateRacingClose(t *testing.T) {
+	for range 20 {
+		store, _ := NewAccountStore("")
+		store.Create(1, 0)
+		e, _ := store.entry(1)
+		e.mu.Lock()
+		deposit := make(chan error)
+		go func() {
+			_, err := store.Update(1, func(a *BankAccount) error {
+				a.Balance += 10
+				return nil
+			})
+			deposit <- err
+		}()
+		time.Sleep(time.Millisecond) // the deposit has the entry and waits
+		// a running goroutine usually beats the one the unlock wakes
+		e.mu.Unlock()
+		closeErr := store.Close(1, anyVersion)
+		if err := <-deposit; err == nil && closeErr == nil {
+			t.Fatal("the deposit succeeded, but the account was closed: the money is gone")
+		}
+	}
+}
+
+func TestTransferStressConserves(t *testing.T) {
+	if res := runTransferStress(10, 5000, 16, false); !res.Conserved() {
+		t.Errorf("locked transfers changed the total from %d to %d", res.ExpectedTotal, res.ActualTotal)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSON representations of the account, so hypermedia driven HTML can be
+// compared with hypermedia JSON on the same model.
+
+const (
+	mediaTypeHTML    = "text/html"
+	mediaTypeHAL     = "application/hal+json"
+	mediaTypeJSONAPI = "application/vnd.api+json"
+)
+
+// accountMediaTypes are the types we serve, preferred first on a tie, with
+// the names an Accept header may ask for them by.
+var accountMediaTypes = []struct {
+	mediaType string
+	names     []string
+}{
+	{mediaTypeHTML, []string{mediaTypeHTML}},
+	{mediaTypeHAL, []string{mediaTypeHAL, "application/json"}},
+	{mediaTypeJSONAPI, []string{mediaTypeJSONAPI}},
+}
+
+// negotiateAccountType picks the type the Accept header rates highest. Each
+// type gets the q of the most specific range matching it, so text/html;q=0
+// beats */*. Plain application/json gets HAL, nothing acceptable HTML.
+func negotiateAccountType(accept string) string {
+	best, bestQ, bestSpecific := mediaTypeHTML, 0.0, 0
+	for _, t := range accountMediaTypes {
+		q, specific := -1.0, 0 // -1: no range matched
+		mainType, _, _ := strings.Cut(t.mediaType, "/")
+		for _, part := range strings.Split(accept, ",") {
+			mediaRange, params, _ := strings.Cut(part, ";")
+			mediaRange = strings.ToLower(strings.TrimSpace(mediaRange))
+			s := 0
+			switch {
+			case slices.Contains(t.names, mediaRange):
+				s = 3
+			case mediaRange == mainType+"/*":
+				s = 2
+			case mediaRange == "*/*":
+				s = 1
+			}
+			if s == 0 || s < specific {
+				continue
+			}
+			rangeQ := parseQ(params)
+			if s > specific || rangeQ > q {
+				q, specific = rangeQ, s
+			}
+		}
+		if q > bestQ || (q == bestQ && q > 0 && specific > bestSpecific) {
+			best, bestQ, bestSpecific = t.mediaType, q, specific
+		}
+	}
+	return best
+}
+
+// parseQ reads the q parameter of a media range, 1 without one.
+func parseQ(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(param, "=")
+		if strings.TrimSpace(name) != "q" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0
+		}
+		return q
+	}
+	return 1
+}
+
+type transactionJSON struct {
+	Kind      string    `json:"kind"`
+	Amount    int       `json:"amount"`
+	CreatedAt time.Time `json:"createdAt"`
+	Actor     string    `json:"actor"`
+	Balance   int       `json:"balance"`
+
+	Counterparty int `json:"counterparty,omitempty"`
+}
+
+func ledgerJSON(ledger []Transaction) []transactionJSON {
+	out := make([]transactionJSON, 0, len(ledger))
+	for _, t := range ledger {
+		out = append(out, transactionJSON(t))
+	}
+	return out
+}
+
+// pageLinks adds links to the neighbouring ledger pages.
+func pageLinks(v AccountView, links map[string]Link) map[string]Link {
+	self := links["self"].Href
+	if v.PrevPage > 0 {
+		links["prev"] = Link{Href: self + "?page=" + strconv.Itoa(v.PrevPage), Method: http.MethodGet}
+	}
+	if v.NextPage > 0 {
+		links["next"] = Link{Href: self + "?page=" + strconv.Itoa(v.NextPage), Method: http.MethodGet}
+	}
+	return links
+}
+
+func accountHAL(v AccountView) any {
+	return struct {
+		Links    map[string]Link `json:"_links"`
+		Id       int             `json:"id"`
+		Balance  int             `json:"balance"`
+		Page     int             `json:"page"`
+		Pages    int             `json:"pages"`
+		Embedded struct {
+			Transactions []transactionJSON `json:"transactions"`
+		} `json:"_embedded"`
+	}{
+		Links:   pageLinks(v, v.Links),
+		Id:      v.Id,
+		Balance: v.Balance,
+		Page:    v.Page,
+		Pages:   v.Pages,
+		Embedded: struct {
+			Transactions []transactionJSON `json:"transactions"`
+		}{ledgerJSON(v.Ledger)},
+	}
+}
+
+// jsonAPILink is a JSON:API link object, which has no method member: the
+// method goes into its meta.
+type jsonAPILink struct {
+	Href  string            `json:"href"`
+	Title string            `json:"title,omitempty"`
+	Meta  map[string]string `json:"meta,omitempty"`
+}
+
+func jsonAPILinks(links map[string]Link) map[string]jsonAPILink {
+	out := make(map[string]jsonAPILink, len(links))
+	for rel, l := range links {
+		link := jsonAPILink{Href: l.Href, Title: l.Title}
+		if l.Method != "" {
+			link.Meta = map[string]string{"method": l.Method}
+		}
+		out[rel] = link
+	}
+	return out
+}
+
+func accountJSONAPI(v AccountView) any {
+	type resource struct {
+		Type       string                 `json:"type"`
+		Id         string                 `json:"id"`
+		Attributes any                    `json:"attributes"`
+		Links      map[string]jsonAPILink `json:"links"`
+	}
+	return struct {
+		Data resource `json:"data"`
+		Meta any      `json:"meta"`
+	}{
+		Data: resource{
+			Type: "accounts",
+			Id:   strconv.Itoa(v.Id),
+			Attributes: struct {
+				Balance      int               `json:"balance"`
+				Transactions []transactionJSON `json:"transactions"`
+			}{v.Balance, ledgerJSON(v.Ledger)},
+			Links: jsonAPILinks(pageLinks(v, v.Links)),
+		},
+		Meta: struct {
+			Page  int `json:"page"`
+			Pages int `json:"pages"`
+		}{v.Page, v.Pages},
+	}
+}
+
+func writeAccountJSON(w http.ResponseWriter, status int, mediaType string, body any) {
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+	}
+}
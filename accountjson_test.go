@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestNegotiateAccountType(t *testing.T) {
+	tests := []struct {
+		accept, want string
+	}{
+		{"", mediaTypeHTML},
+		{"*/*", mediaTypeHTML},
+		{"text/html", mediaTypeHTML},
+		{"application/json", mediaTypeHAL},
+		{"application/hal+json", mediaTypeHAL},
+		{"application/vnd.api+json", mediaTypeJSONAPI},
+		{"application/json;q=0.1, text/html", mediaTypeHTML},
+		{"text/html;q=0.5, application/vnd.api+json", mediaTypeJSONAPI},
+		{"text/html;q=0, */*", mediaTypeHAL},
+		{"application/*", mediaTypeHAL},
+		{"application/*;q=0.9, application/vnd.api+json", mediaTypeJSONAPI},
+		{"application/json, */*;q=0.8", mediaTypeHAL},
+		{"text/html, application/xhtml+xml, */*;q=0.8", mediaTypeHTML},
+		{"image/png", mediaTypeHTML},
+		{"application/json;q=0", mediaTypeHTML},
+		{"Application/JSON", mediaTypeHAL},
+		{"application/json; charset=utf-8; q=0.3, text/html;q=0.2", mediaTypeHAL},
+	}
+	for _, tt := range tests {
+		if got := negotiateAccountType(tt.accept); got != tt.want {
+			t.Errorf("negotiateAccountType(%q) = %s, want %s", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestJSONAPILinksMoveMethodToMeta(t *testing.T) {
+	links := jsonAPILinks(map[string]Link{
+		"self":     {Href: "/account/1", Method: "GET"},
+		"withdraw": {Href: "/account/1/withdrawal", Method: "POST", Title: "Withdraw"},
+		"plain":    {Href: "/x"},
+	})
+	if got := links["withdraw"]; got.Meta["method"] != "POST" || got.Title != "Withdraw" {
+		t.Errorf("withdraw link: %+v", got)
+	}
+	if got := links["plain"]; got.Meta != nil {
+		t.Errorf("a link without method got meta: %+v", got)
+	}
+}
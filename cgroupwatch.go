@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Since go 1.25 the runtime re-derives GOMAXPROCS when the container CPU
+// limit changes. The watcher records every change, so resizing the pod's CPU
+// limit in place shows the runtime reacting on the load page.
+
+type GomaxprocsChange struct {
+	At         time.Time
+	Gomaxprocs int
+	CPUMax     string
+	Source     string
+}
+
+const (
+	cgroupWatchEvery   = time.Second
+	maxTimelineEntries = 100
+)
+
+var (
+	timelineMu sync.Mutex
+	timeline   []GomaxprocsChange
+)
+
+func readCPUMax() string {
+	contents, err := os.ReadFile("/sys/fs/cgroup/cpu.max")
+	if err != nil {
+		return "unavailable"
+	}
+	return strings.TrimSpace(string(contents))
+}
+
+func recordGomaxprocsChange(c GomaxprocsChange) {
+	timelineMu.Lock()
+	defer timelineMu.Unlock()
+	timeline = append(timeline, c)
+	if len(timeline) > maxTimelineEntries {
+		timeline = timeline[len(timeline)-maxTimelineEntries:]
+	}
+}
+
+func watchGomaxprocs() {
+	last := GomaxprocsChange{At: time.Now(), Gomaxprocs: runtime.GOMAXPROCS(0), CPUMax: readCPUMax(), Source: gomaxprocsSourceString()}
+	recordGomaxprocsChange(last)
+
+	ticker := time.NewTicker(cgroupWatchEvery)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		n, cpuMax := runtime.GOMAXPROCS(0), readCPUMax()
+		if n == last.Gomaxprocs && cpuMax == last.CPUMax {
+			continue
+		}
+		last = GomaxprocsChange{At: now, Gomaxprocs: n, CPUMax: cpuMax, Source: gomaxprocsSourceString()}
+		fmt.Printf("gomaxprocs changed: gomaxprocs=%d cpu.max=%q source=%s\n", n, cpuMax, last.Source)
+		recordGomaxprocsChange(last)
+	}
+}
+
+func timelineHandler(w http.ResponseWriter, r *http.Request) {
+	timelineMu.Lock()
+	// newest first
+	entries := make([]GomaxprocsChange, len(timeline))
+	for i, c := range timeline {
+		entries[len(timeline)-1-i] = c
+	}
+	timelineMu.Unlock()
+
+	templatePath := filepath.Join("templates", "gomaxprocs-timeline.html")
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, entries)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+type Comment struct {
+	Id        int
+	Author    string
+	Content   string // stored as posted, rendered according to the lab's mode
+	CreatedAt time.Time
+}
+
+var errCommentNotFound = errors.New("comment not found")
+
+// CommentStore guards the comments of the XSS lab with a mutex and persists
+// them to a JSON file, so several people can post at once and the stored
+// payloads survive restarts.
+type CommentStore struct {
+	mu       sync.Mutex
+	comments []Comment // oldest first
+	nextId   int
+	path     string
+}
+
+func NewCommentStore(path string) (*CommentStore, error) {
+	s := &CommentStore{nextId: 1, path: path}
+	if path == "" {
+		return s, nil
+	}
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, &s.comments); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, c := range s.comments {
+		s.nextId = max(s.nextId, c.Id+1)
+	}
+	return s, nil
+}
+
+// save writes all comments to disk, failures are only logged. Caller must hold s.mu.
+func (s *CommentStore) save() {
+	if s.path == "" {
+		return
+	}
+	contents, err := json.MarshalIndent(s.comments, "", "  ")
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, contents, 0o644); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		fmt.Println("couldn't persist comments to", s.path, "err:", err)
+	}
+}
+
+func (s *CommentStore) List() []Comment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.comments)
+}
+
+func (s *CommentStore) Add(c Comment) Comment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.Id = s.nextId
+	s.nextId++
+	s.comments = append(s.comments, c)
+	s.save()
+	return c
+}
+
+func (s *CommentStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.comments, func(c Comment) bool { return c.Id == id })
+	if i < 0 {
+		return errCommentNotFound
+	}
+	s.comments = slices.Delete(s.comments, i, i+1)
+	s.save()
+	return nil
+}
+
+// Pop removes the newest comment, if there is one.
+func (s *CommentStore) Pop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.comments) == 0 {
+		return
+	}
+	s.comments = s.comments[:len(s.comments)-1]
+	s.save()
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Contacts back the htmx click-to-edit demo on the index page.
+
+type Contact struct {
+	Id        int
+	FirstName string
+	LastName  string
+	Email     string
+	Active    bool
+}
+
+// ContactForm is a contact being edited, with the validation errors per field.
+type ContactForm struct {
+	Contact
+	Errors map[string]string
+}
+
+const maxContactField = 100
+
+var errContactNotFound = errors.New("contact not found")
+
+// validate trims the fields and returns the problems, keyed by field name.
+func (c *Contact) validate() map[string]string {
+	c.FirstName = strings.TrimSpace(c.FirstName)
+	c.LastName = strings.TrimSpace(c.LastName)
+	c.Email = strings.TrimSpace(c.Email)
+
+	errs := map[string]string{}
+	if c.FirstName == "" {
+		errs["firstName"] = "First name is required"
+	}
+	if c.LastName == "" {
+		errs["lastName"] = "Last name is required"
+	}
+	if addr, err := mail.ParseAddress(c.Email); err != nil || addr.Address != c.Email {
+		errs["email"] = "Enter a valid email address like joe@blow.com"
+	}
+	for field, v := range map[string]string{"firstName": c.FirstName, "lastName": c.LastName, "email": c.Email} {
+		if len(v) > maxContactField {
+			errs[field] = fmt.Sprintf("At most %d characters", maxContactField)
+		}
+	}
+	return errs
+}
+
+// ContactStore keeps contacts in memory and persists them to a JSON file,
+// like the AccountStore.
+type ContactStore struct {
+	mu       sync.Mutex
+	contacts map[int]Contact
+	nextId   int
+	path     string
+}
+
+func NewContactStore(path string) (*ContactStore, error) {
+	s := &ContactStore{contacts: map[int]Contact{}, nextId: 1, path: path}
+	if path == "" {
+		return s, nil
+	}
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var contacts []Contact
+	if err := json.Unmarshal(contents, &contacts); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, c := range contacts {
+		s.contacts[c.Id] = c
+		s.nextId = max(s.nextId, c.Id+1)
+	}
+	return s, nil
+}
+
+// save writes all contacts to disk, failures are only logged. Caller must hold s.mu.
+func (s *ContactStore) save() {
+	if s.path == "" {
+		return
+	}
+	contents, err := json.MarshalIndent(s.list(), "", "  ")
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, contents, 0o644); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		fmt.Println("couldn't persist contacts to", s.path, "err:", err)
+	}
+}
+
+// list returns the contacts by id. Caller must hold s.mu.
+func (s *ContactStore) list() []Contact {
+	contacts := make([]Contact, 0, len(s.contacts))
+	for _, c := range s.contacts {
+		contacts = append(contacts, c)
+	}
+	slices.SortFunc(contacts, func(a, b Contact) int { return a.Id - b.Id })
+	return contacts
+}
+
+func (s *ContactStore) List() []Contact {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list()
+}
+
+func (s *ContactStore) Get(id int) (Contact, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.contacts[id]
+	if !ok {
+		return Contact{}, errContactNotFound
+	}
+	return c, nil
+}
+
+func (s *ContactStore) Create(c Contact) Contact {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.Id = s.nextId
+	s.nextId++
+	s.contacts[c.Id] = c
+	s.save()
+	return c
+}
+
+func (s *ContactStore) Update(c Contact) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.contacts[c.Id]; !ok {
+		return errContactNotFound
+	}
+	s.contacts[c.Id] = c
+	s.save()
+	return nil
+}
+
+func (s *ContactStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.contacts[id]; !ok {
+		return errContactNotFound
+	}
+	delete(s.contacts, id)
+	s.save()
+	return nil
+}
+
+// Search returns the contacts whose name or email contains q, ignoring case.
+func (s *ContactStore) Search(q string) []Contact {
+	q = strings.ToLower(strings.TrimSpace(q))
+	var found []Contact
+	for _, c := range s.List() {
+		if strings.Contains(strings.ToLower(c.FirstName+" "+c.LastName+" "+c.Email), q) {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+// Page returns up to limit contacts starting at offset, and whether more follow.
+func (s *ContactStore) Page(offset, limit int) ([]Contact, bool) {
+	all := s.List()
+	if offset >= len(all) {
+		return nil, false
+	}
+	end := min(offset+limit, len(all))
+	return all[offset:end], end < len(all)
+}
+
+// SetActive (de)activates the given contacts and returns the ones it changed.
+func (s *ContactStore) SetActive(ids []int, active bool) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var changed []int
+	for _, id := range ids {
+		c, ok := s.contacts[id]
+		if !ok || c.Active == active {
+			continue
+		}
+		c.Active = active
+		s.contacts[id] = c
+		changed = append(changed, id)
+	}
+	if len(changed) > 0 {
+		s.save()
+	}
+	return changed
+}
+
+var contacts *ContactStore
+
+func contactFromForm(r *http.Request) Contact {
+	return Contact{
+		FirstName: r.FormValue("firstName"),
+		LastName:  r.FormValue("lastName"),
+		Email:     r.FormValue("email"),
+	}
+}
+
+// contactFromRequest looks up the {id} path value, answering 404 itself.
+func contactFromRequest(w http.ResponseWriter, r *http.Request) (Contact, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return Contact{}, false
+	}
+	c, err := contacts.Get(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return Contact{}, false
+	}
+	return c, true
+}
+
+// renderContactTemplate executes one of the contact templates, which may use
+// the list, view and form fragments.
+func renderContactTemplate(w http.ResponseWriter, name string, status int, data any) {
+	tmpl, err := template.ParseFiles(
+		filepath.Join("templates", name),
+		filepath.Join("templates", "contact-list.html"),
+		filepath.Join("templates", "contact-view.html"),
+		filepath.Join("templates", "contact-form.html"),
+	)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+		fmt.Println("render error:", err)
+	}
+}
+
+func contactsPageHandler(w http.ResponseWriter, r *http.Request) {
+	renderContactTemplate(w, "contacts.html", http.StatusOK, struct {
+		Contacts []Contact
+		New      ContactForm
+	}{contacts.List(), ContactForm{}})
+}
+
+// createContactHandler answers with the form again: with the errors when
+// invalid, else blank, and triggers a reload of the list.
+func createContactHandler(w http.ResponseWriter, r *http.Request) {
+	c := contactFromForm(r)
+	if errs := c.validate(); len(errs) > 0 {
+		renderContactTemplate(w, "contact-form.html", http.StatusUnprocessableEntity, ContactForm{c, errs})
+		return
+	}
+	contacts.Create(c)
+	w.Header().Set("HX-Trigger", "contactsChanged")
+	renderContactTemplate(w, "contact-form.html", http.StatusCreated, ContactForm{})
+}
+
+func contactListHandler(w http.ResponseWriter, r *http.Request) {
+	renderContactTemplate(w, "contact-list.html", http.StatusOK, contacts.List())
+}
+
+func contactViewHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := contactFromRequest(w, r)
+	if !ok {
+		return
+	}
+	renderContactTemplate(w, "contact-view.html", http.StatusOK, c)
+}
+
+func contactEditHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := contactFromRequest(w, r)
+	if !ok {
+		return
+	}
+	renderContactTemplate(w, "contact-form.html", http.StatusOK, ContactForm{Contact: c})
+}
+
+// updateContactHandler answers with the view on success, else with the form
+// showing the errors inline.
+func updateContactHandler(w http.ResponseWriter, r *http.Request) {
+	current, ok := contactFromRequest(w, r)
+	if !ok {
+		return
+	}
+	c := contactFromForm(r)
+	c.Id, c.Active = current.Id, current.Active
+	if errs := c.validate(); len(errs) > 0 {
+		renderContactTemplate(w, "contact-form.html", http.StatusUnprocessableEntity, ContactForm{c, errs})
+		return
+	}
+	if err := contacts.Update(c); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("HX-Trigger", "contactsChanged")
+	renderContactTemplate(w, "contact-view.html", http.StatusOK, c)
+}
+
+// deleteContactHandler answers with an empty 200, so htmx swaps the element away.
+func deleteContactHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := contactFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := contacts.Delete(c.Id); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("HX-Trigger", "contactsChanged")
+	w.WriteHeader(http.StatusOK)
+}
+
+func setupContacts(mux *http.ServeMux) {
+	var err error
+	contacts, err = NewContactStore(envOr("CONTACTS_FILE", filepath.Join("nfs", "contacts.json")))
+	if err != nil {
+		fmt.Println("couldn't load contacts, starting empty:", err)
+		contacts, _ = NewContactStore("")
+	}
+	// the contact the click-to-edit example on the index page shows
+	if len(contacts.List()) == 0 {
+		contacts.Create(Contact{FirstName: "Joe", LastName: "Blow", Email: "joe@blow.com", Active: true})
+	}
+
+	mux.HandleFunc("GET /contacts", contactsPageHandler)
+	mux.HandleFunc("POST /contacts", createContactHandler)
+	mux.HandleFunc("GET /contacts/list", contactListHandler)
+	mux.HandleFunc("GET /contact/{id}", contactViewHandler)
+	mux.HandleFunc("GET /contact/{id}/edit", contactEditHandler)
+	mux.HandleFunc("PUT /contact/{id}", updateContactHandler)
+	mux.HandleFunc("DELETE /contact/{id}", deleteContactHandler)
+}
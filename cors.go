@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS: which other origins may read our responses, and with what. Each
+// route that allows it gets a policy, and /cors explains for a given
+// Origin, method and headers whether a browser would let the request pass.
+
+type CORSPolicy struct {
+	Name string
+	// exact origins, "*", or patterns like "http://localhost:*" and
+	// "https://*.example.com", matched with path.Match
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+var (
+	// publicCORS lets any page read the response, but never with cookies.
+	publicCORS = &CORSPolicy{
+		Name:           "public",
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet, http.MethodHead},
+		MaxAge:         10 * time.Minute,
+	}
+
+	// accountCORS lets trusted frontends read the account API with the
+	// user's session, CORS_TRUSTED_ORIGINS is a comma separated list. Only
+	// reading: csrfProtect refuses every cross-origin mutation anyway.
+	accountCORS = &CORSPolicy{
+		Name:             "account API",
+		AllowedOrigins:   strings.Split(envOr("CORS_TRUSTED_ORIGINS", "http://localhost:3000"), ","),
+		AllowedMethods:   []string{http.MethodGet, http.MethodHead},
+		AllowedHeaders:   []string{"If-None-Match"},
+		ExposedHeaders:   []string{"ETag"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+)
+
+// CORSRoute is listed on the diagnostic page.
+type CORSRoute struct {
+	Route  string
+	Policy *CORSPolicy
+}
+
+var corsRoutes = []CORSRoute{
+	{"/json", nil},
+	{"/json?cors", publicCORS},
+	{"/cors", publicCORS},
+	{"/account/{id}", accountCORS},
+}
+
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	for _, pattern := range p.AllowedOrigins {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		if ok, _ := path.Match(pattern, origin); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin is the Access-Control-Allow-Origin value for an allowed
+// origin. With credentials it must name the origin, "*" doesn't count then.
+func (p *CORSPolicy) allowOrigin(origin string) string {
+	if slices.Contains(p.AllowedOrigins, "*") && !p.AllowCredentials {
+		return "*"
+	}
+	return origin
+}
+
+// responseHeaders are set on the actual response to an allowed origin.
+func (p *CORSPolicy) responseHeaders(origin string) http.Header {
+	h := http.Header{}
+	h.Set("Access-Control-Allow-Origin", p.allowOrigin(origin))
+	if p.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(p.ExposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+	}
+	return h
+}
+
+// containsFold reports whether list contains name, header names ignore case.
+func containsFold(list []string, name string) bool {
+	return slices.ContainsFunc(list, func(s string) bool { return strings.EqualFold(s, name) })
+}
+
+// preflight answers an OPTIONS preflight, or returns why it's refused.
+func (p *CORSPolicy) preflight(origin, method string, headers []string) (http.Header, string) {
+	if !p.allowsOrigin(origin) {
+		return nil, "origin " + origin + " isn't allowed"
+	}
+	if !slices.Contains(p.AllowedMethods, method) {
+		return nil, "method " + method + " isn't allowed, only " + strings.Join(p.AllowedMethods, ", ")
+	}
+	for _, name := range headers {
+		if !containsFold(p.AllowedHeaders, name) {
+			return nil, "header " + name + " isn't allowed"
+		}
+	}
+	h := http.Header{}
+	h.Set("Access-Control-Allow-Origin", p.allowOrigin(origin))
+	if p.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+	if len(p.AllowedHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+	}
+	if p.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+	}
+	return h, ""
+}
+
+// handleCORS sets the policy's headers, and answers preflights itself, in
+// which case it returns true.
+func handleCORS(w http.ResponseWriter, r *http.Request, p *CORSPolicy) bool {
+	origin := r.Header.Get("Origin")
+	w.Header().Add("Vary", "Origin")
+	if origin == "" {
+		return false
+	}
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		var requested []string
+		for _, name := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				requested = append(requested, name)
+			}
+		}
+		h, reason := p.preflight(origin, r.Header.Get("Access-Control-Request-Method"), requested)
+		if reason != "" {
+			// without the headers the browser refuses the actual request
+			fmt.Printf("cors: refused preflight for %s %s: %s\n", origin, r.URL.Path, reason)
+			w.WriteHeader(http.StatusNoContent)
+			return true
+		}
+		for k, v := range h {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	// a simple request with another method is sent without a preflight,
+	// but the page mustn't read the answer
+	if p.allowsOrigin(origin) && slices.Contains(p.AllowedMethods, r.Method) {
+		for k, v := range p.responseHeaders(origin) {
+			w.Header()[k] = v
+		}
+	}
+	return false
+}
+
+// withCORS applies a policy to a route.
+func withCORS(p *CORSPolicy, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if handleCORS(w, r, p) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// CORSCheck is a cross-origin request as the diagnostic page describes it.
+type CORSCheck struct {
+	Route       string
+	Origin      string
+	Method      string
+	Headers     []string // besides Content-Type
+	ContentType string
+	Credentials bool
+}
+
+type CORSDiagnosis struct {
+	Allowed          bool
+	Preflight        bool
+	Steps            []string // what the browser and server do, in order
+	PreflightHeaders http.Header
+	ResponseHeaders  http.Header
+}
+
+var safelistedHeaders = []string{"Accept", "Accept-Language", "Content-Language"}
+var safelistedContentTypes = []string{"", "application/x-www-form-urlencoded", "multipart/form-data", "text/plain"}
+
+// diagnoseCORS replays what a browser would do with the check against policy p.
+func diagnoseCORS(c CORSCheck, p *CORSPolicy) CORSDiagnosis {
+	var d CORSDiagnosis
+	step := func(format string, args ...any) { d.Steps = append(d.Steps, fmt.Sprintf(format, args...)) }
+
+	// the preflight only asks for the headers that aren't safelisted
+	var unsafe []string
+	for _, name := range c.Headers {
+		if !containsFold(safelistedHeaders, name) {
+			unsafe = append(unsafe, name)
+		}
+	}
+	if !slices.Contains(safelistedContentTypes, c.ContentType) {
+		unsafe = append(unsafe, "Content-Type")
+	}
+	simpleMethod := c.Method == http.MethodGet || c.Method == http.MethodHead || c.Method == http.MethodPost
+	d.Preflight = !simpleMethod || len(unsafe) > 0
+
+	if p == nil {
+		if d.Preflight {
+			step("%s sends no CORS headers, so the preflight the request needs fails and the request isn't even sent", c.Route)
+		} else {
+			step("%s sends no CORS headers, the browser sends the request but won't let the page read the response", c.Route)
+		}
+		return d
+	}
+	step("%s uses the %q policy", c.Route, p.Name)
+
+	if d.Preflight {
+		why := "the method " + c.Method + " isn't GET, HEAD or POST"
+		if simpleMethod {
+			why = "of the headers " + strings.Join(unsafe, ", ")
+		}
+		step("the browser sends an OPTIONS preflight first, because %s", why)
+		h, reason := p.preflight(c.Origin, c.Method, unsafe)
+		if reason != "" {
+			step("the preflight fails: %s. The request isn't sent", reason)
+			return d
+		}
+		d.PreflightHeaders = h
+		step("the preflight passes, the browser may cache that for %s", p.MaxAge)
+	} else {
+		step("no preflight, it's a simple request: the browser sends it right away")
+	}
+
+	if !p.allowsOrigin(c.Origin) {
+		step("origin %s isn't allowed, the response has no Access-Control-Allow-Origin and the page can't read it", c.Origin)
+		return d
+	}
+	if !slices.Contains(p.AllowedMethods, c.Method) {
+		step("the server handles the request, but the policy only allows %s: the response has no Access-Control-Allow-Origin and the page can't read it", strings.Join(p.AllowedMethods, ", "))
+		return d
+	}
+	d.ResponseHeaders = p.responseHeaders(c.Origin)
+	if c.Credentials {
+		if d.ResponseHeaders.Get("Access-Control-Allow-Origin") == "*" {
+			step("the request carries cookies, but Access-Control-Allow-Origin is *, which doesn't count for credentialed requests")
+			return d
+		}
+		if !p.AllowCredentials {
+			step("the request carries cookies, but the response lacks Access-Control-Allow-Credentials: true")
+			return d
+		}
+		step("cookies are sent, and the response allows credentials")
+	}
+	step("Access-Control-Allow-Origin: %s matches, the page can read the response", d.ResponseHeaders.Get("Access-Control-Allow-Origin"))
+	if len(p.ExposedHeaders) > 0 {
+		step("besides the safelisted response headers, it can read %s", strings.Join(p.ExposedHeaders, ", "))
+	}
+	d.Allowed = true
+	return d
+}
+
+func corsRoutePolicy(route string) (*CORSPolicy, bool) {
+	for _, cr := range corsRoutes {
+		if cr.Route == route {
+			return cr.Policy, true
+		}
+	}
+	return nil, false
+}
+
+// corsExampleHandler is the diagnostic page.
+func corsExampleHandler(w http.ResponseWriter, r *http.Request) {
+	templatePath := filepath.Join("templates", "cors-example.html")
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, struct {
+		Routes       []CORSRoute
+		ContentTypes []string
+	}{corsRoutes, append(slices.Clone(safelistedContentTypes), "application/json")})
+}
+
+func corsCheckHandler(w http.ResponseWriter, r *http.Request) {
+	c := CORSCheck{
+		Route:       r.FormValue("route"),
+		Origin:      strings.TrimSpace(r.FormValue("origin")),
+		Method:      strings.ToUpper(strings.TrimSpace(r.FormValue("method"))),
+		ContentType: r.FormValue("contentType"),
+		Credentials: r.FormValue("credentials") != "",
+	}
+	for _, name := range strings.Split(r.FormValue("headers"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			c.Headers = append(c.Headers, name)
+		}
+	}
+	p, ok := corsRoutePolicy(c.Route)
+	if !ok || c.Origin == "" || c.Method == "" {
+		http.Error(w, "pick a route, and enter an origin and a method", http.StatusBadRequest)
+		return
+	}
+	templatePath := filepath.Join("templates", "cors-diagnosis.html")
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, diagnoseCORS(c, p))
+}
+
+func setupCORS(mux *http.ServeMux) {
+	mux.HandleFunc("/cors", withCORS(publicCORS, corsExampleHandler))
+	mux.HandleFunc("GET /cors/check", corsCheckHandler)
+}
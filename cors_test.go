@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowsOrigin(t *testing.T) {
+	p := &CORSPolicy{AllowedOrigins: []string{"http://localhost:*", "https://*.example.com", " https://app.test"}}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"http://localhost:3000", true},
+		{"http://localhost", false},
+		{"https://localhost:3000", false},
+		{"https://shop.example.com", true},
+		{"https://example.com", false},
+		{"https://evil.com/.example.com", false},
+		{"https://app.test", true},
+		{"https://app.test.evil.com", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		if got := p.allowsOrigin(tt.origin); got != tt.want {
+			t.Errorf("allowsOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestDiagnoseCORS(t *testing.T) {
+	trusted := &CORSPolicy{
+		Name:             "trusted",
+		AllowedOrigins:   []string{"http://localhost:3000"},
+		AllowedMethods:   []string{http.MethodGet, http.MethodHead},
+		AllowedHeaders:   []string{"If-None-Match"},
+		AllowCredentials: true,
+	}
+	tests := []struct {
+		name          string
+		check         CORSCheck
+		policy        *CORSPolicy
+		wantAllowed   bool
+		wantPreflight bool
+	}{
+		{"no policy", CORSCheck{Origin: "http://a.test", Method: "GET"}, nil, false, false},
+		{"public GET", CORSCheck{Origin: "http://a.test", Method: "GET"}, publicCORS, true, false},
+		{"public with cookies", CORSCheck{Origin: "http://a.test", Method: "GET", Credentials: true}, publicCORS, false, false},
+		{"public PUT", CORSCheck{Origin: "http://a.test", Method: "PUT"}, publicCORS, false, true},
+		{"public simple POST", CORSCheck{Origin: "http://a.test", Method: "POST", ContentType: "text/plain"}, publicCORS, false, false},
+		{"JSON body needs a preflight", CORSCheck{Origin: "http://a.test", Method: "GET", ContentType: "application/json"}, publicCORS, false, true},
+		{"trusted with cookies", CORSCheck{Origin: "http://localhost:3000", Method: "GET", Credentials: true}, trusted, true, false},
+		{"trusted header", CORSCheck{Origin: "http://localhost:3000", Method: "GET", Headers: []string{"if-none-match"}}, trusted, true, true},
+		{"header not allowed", CORSCheck{Origin: "http://localhost:3000", Method: "GET", Headers: []string{"X-CSRF-Token"}}, trusted, false, true},
+		{"safelisted header", CORSCheck{Origin: "http://localhost:3000", Method: "GET", Headers: []string{"Accept"}}, trusted, true, false},
+		{"untrusted origin", CORSCheck{Origin: "http://evil.test", Method: "GET"}, trusted, false, false},
+	}
+	for _, tt := range tests {
+		d := diagnoseCORS(tt.check, tt.policy)
+		if d.Allowed != tt.wantAllowed || d.Preflight != tt.wantPreflight {
+			t.Errorf("%s: allowed=%v preflight=%v, want %v %v; steps: %q", tt.name, d.Allowed, d.Preflight, tt.wantAllowed, tt.wantPreflight, d.Steps)
+		}
+	}
+}
+
+// TestHandleCORSWithholdsOtherMethods: a cross-origin simple POST reaches
+// the handler, but the page mustn't be allowed to read the answer.
+func TestHandleCORSWithholdsOtherMethods(t *testing.T) {
+	for method, want := range map[string]string{"GET": "*", "POST": ""} {
+		r := httptest.NewRequest(method, "/json?cors", nil)
+		r.Header.Set("Origin", "http://a.test")
+		w := httptest.NewRecorder()
+		if handleCORS(w, r, publicCORS) {
+			t.Fatalf("%s was answered as a preflight", method)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("%s: Access-Control-Allow-Origin %q, want %q", method, got, want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Content-Security-Policy lab: the XSS pages can be served under different
+// policies, to show how CSP blocks the same payloads the lab demonstrates.
+// Browsers send the violations to /csp-report, and /csp shows them live.
+
+const (
+	cspNone        = "none"             // no header, the payloads run
+	cspReportOnly  = "report-only"      // the strict policy, but only reported
+	cspStrictNonce = "strict-nonce"     // only scripts carrying this response's nonce run
+	cspLegacyAllow = "legacy-allowlist" // scripts from allowlisted hosts run
+	maxCSPReports  = 100
+	cspReportPath  = "/csp-report"
+)
+
+var cspPolicies = []string{cspNone, cspReportOnly, cspStrictNonce, cspLegacyAllow}
+
+var (
+	cspMu     sync.Mutex
+	cspPolicy = envOr("CSP_POLICY", cspNone)
+)
+
+func currentCSPPolicy() string {
+	cspMu.Lock()
+	defer cspMu.Unlock()
+	return cspPolicy
+}
+
+// cspHeader returns the header name and value for a policy, "" for none.
+// Inline event handlers like onerror have no nonce, so the strict policy
+// blocks them, and so does the allowlist. The allowlist still trusts
+// whole CDNs though, any script hosted there can be loaded by a payload.
+func cspHeader(policy, nonce string) (string, string) {
+	report := "; report-uri " + cspReportPath + "; report-to csp"
+	strict := "script-src 'nonce-" + nonce + "'; object-src 'none'; base-uri 'none'" + report
+	switch policy {
+	case cspReportOnly:
+		return "Content-Security-Policy-Report-Only", strict
+	case cspStrictNonce:
+		return "Content-Security-Policy", strict
+	case cspLegacyAllow:
+		return "Content-Security-Policy", "script-src 'self' https://cdn.jsdelivr.net https://unpkg.com; object-src 'none'" + report
+	}
+	return "", ""
+}
+
+type cspNonceKey struct{}
+
+// cspNonce is the nonce of the current response, templates put it on their
+// script tags. It's empty for routes not wrapped in cspDecorator.
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+// cspDecorator sets the selected policy with a fresh nonce on every response.
+func cspDecorator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := randomState()
+		if name, value := cspHeader(currentCSPPolicy(), nonce); name != "" {
+			w.Header().Set("Reporting-Endpoints", `csp="`+cspReportPath+`"`)
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce)))
+	})
+}
+
+// CSPReport is a violation, from either the legacy report-uri format or
+// the Reporting API that report-to uses.
+type CSPReport struct {
+	Received          time.Time
+	DocumentURI       string `json:"document-uri"`
+	ViolatedDirective string `json:"violated-directive"`
+	BlockedURI        string `json:"blocked-uri"`
+	SourceFile        string `json:"source-file"`
+	LineNumber        int    `json:"line-number"`
+	Sample            string `json:"script-sample"`
+	Disposition       string `json:"disposition"`
+}
+
+var (
+	cspReportsMu sync.Mutex
+	cspReports   []CSPReport // newest first
+)
+
+func addCSPReport(rep CSPReport) {
+	cspReportsMu.Lock()
+	defer cspReportsMu.Unlock()
+	rep.Received = time.Now()
+	cspReports = slices.Insert(cspReports, 0, rep)
+	if len(cspReports) > maxCSPReports {
+		cspReports = cspReports[:maxCSPReports]
+	}
+}
+
+func listCSPReports() []CSPReport {
+	cspReportsMu.Lock()
+	defer cspReportsMu.Unlock()
+	return slices.Clone(cspReports)
+}
+
+// parseCSPReports reads a report-uri body, {"csp-report": {...}}, or a
+// Reporting API body, [{"type": "csp-violation", "body": {...}}].
+func parseCSPReports(contentType string, body []byte) ([]CSPReport, error) {
+	if strings.HasPrefix(contentType, "application/reports+json") {
+		var batch []struct {
+			Type string `json:"type"`
+			Body struct {
+				DocumentURL        string `json:"documentURL"`
+				EffectiveDirective string `json:"effectiveDirective"`
+				BlockedURL         string `json:"blockedURL"`
+				SourceFile         string `json:"sourceFile"`
+				LineNumber         int    `json:"lineNumber"`
+				Sample             string `json:"sample"`
+				Disposition        string `json:"disposition"`
+			} `json:"body"`
+		}
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, err
+		}
+		var reports []CSPReport
+		for _, b := range batch {
+			if b.Type != "csp-violation" {
+				continue
+			}
+			reports = append(reports, CSPReport{
+				DocumentURI:       b.Body.DocumentURL,
+				ViolatedDirective: b.Body.EffectiveDirective,
+				BlockedURI:        b.Body.BlockedURL,
+				SourceFile:        b.Body.SourceFile,
+				LineNumber:        b.Body.LineNumber,
+				Sample:            b.Body.Sample,
+				Disposition:       b.Body.Disposition,
+			})
+		}
+		return reports, nil
+	}
+	var legacy struct {
+		Report CSPReport `json:"csp-report"`
+	}
+	if err := json.Unmarshal(body, &legacy); err != nil {
+		return nil, err
+	}
+	return []CSPReport{legacy.Report}, nil
+}
+
+func cspReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "couldn't read report", http.StatusBadRequest)
+		return
+	}
+	reports, err := parseCSPReports(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		http.Error(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, rep := range reports {
+		fmt.Printf("csp violation: %s blocked %q on %s\n", rep.ViolatedDirective, rep.BlockedURI, rep.DocumentURI)
+		addCSPReport(rep)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func cspPageHandler(w http.ResponseWriter, r *http.Request) {
+	templatePath := filepath.Join("templates", "csp.html")
+	tmpl, err := template.ParseFiles(templatePath, filepath.Join("templates", "csp-reports.html"))
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	policy := currentCSPPolicy()
+	_, header := cspHeader(policy, "{nonce}")
+	tmpl.Execute(w, struct {
+		Policy    string
+		Policies  []string
+		Header    string
+		Reports   []CSPReport
+		CSRFToken string
+	}{policy, cspPolicies, header, listCSPReports(), csrfToken(w, r)})
+}
+
+func cspReportsHandler(w http.ResponseWriter, r *http.Request) {
+	templatePath := filepath.Join("templates", "csp-reports.html")
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, listCSPReports())
+}
+
+func cspReportsClearHandler(w http.ResponseWriter, r *http.Request) {
+	cspReportsMu.Lock()
+	cspReports = nil
+	cspReportsMu.Unlock()
+	w.Header().Set("HX-Trigger", "cspReportsChanged")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func cspPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	policy := r.FormValue("policy")
+	if !slices.Contains(cspPolicies, policy) {
+		http.Error(w, "unknown policy", http.StatusBadRequest)
+		return
+	}
+	cspMu.Lock()
+	cspPolicy = policy
+	cspMu.Unlock()
+	fmt.Println("csp policy:", policy)
+	// the page shows the header of the new policy
+	w.Header().Set("HX-Refresh", "true")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setupCSP(mux *http.ServeMux) {
+	if !slices.Contains(cspPolicies, cspPolicy) {
+		fmt.Printf("unknown CSP_POLICY %q, using %q\n", cspPolicy, cspNone)
+		cspPolicy = cspNone
+	}
+	mux.HandleFunc(cspReportPath, cspReportHandler)
+	mux.HandleFunc("GET /csp", cspPageHandler)
+	mux.HandleFunc("GET /csp/reports", cspReportsHandler)
+	// global state, another site mustn't switch the policy off for everyone
+	mux.HandleFunc("POST /csp/reports/clear", csrfProtect(cspReportsClearHandler))
+	mux.HandleFunc("POST /csp/policy", csrfProtect(cspPolicyHandler))
+}
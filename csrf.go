@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Cross-site request forgery protection for the comment and account
+// mutations. A request must pass three checks:
+//
+//   - Fetch Metadata: browsers send Sec-Fetch-Site, anything but
+//     same-origin (or none, typed into the address bar) is refused.
+//   - Synchronizer token: the token kept in the session must come back in
+//     the X-CSRF-Token header or the csrf_token form field.
+//   - Double submit: the same token must also come back as a cookie, which
+//     another site can't read or set for us.
+//
+// Pages put the token into hx-headers on <body>, so every htmx request
+// below it sends it. CSRF_PROTECTION=off, or the switch on /csrf, turns it
+// off to demonstrate the attack.
+
+const (
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+	csrfCookie = "csrf_token"
+)
+
+var csrfEnabled atomic.Bool
+
+// csrfToken returns the session's token, creating it and the double-submit
+// cookie on first use. It must be called before the response is written.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	session, _ := store.Get(r, "csrf")
+	token, _ := session.Values["token"].(string)
+	if token == "" {
+		token = randomState()
+		session.Values["token"] = token
+		if err := session.Save(r, w); err != nil {
+			fmt.Println("couldn't save csrf session:", err)
+		}
+	}
+	if c, err := r.Cookie(csrfCookie); err != nil || c.Value != token {
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   store.Options.Secure,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	return token
+}
+
+// checkCSRF returns why a request is refused, "" if it passes.
+func checkCSRF(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ""
+	}
+	site := r.Header.Get("Sec-Fetch-Site")
+	if site != "" && site != "same-origin" && site != "none" {
+		return "Sec-Fetch-Site is " + site
+	}
+	// no cookies and no browser headers: a client like curl, which has no
+	// session another site could ride on
+	if len(r.Cookies()) == 0 && site == "" && r.Header.Get("Origin") == "" {
+		return ""
+	}
+
+	session, _ := store.Get(r, "csrf")
+	expected, _ := session.Values["token"].(string)
+	if expected == "" {
+		return "no CSRF token in the session, reload the page"
+	}
+	sent := r.Header.Get(csrfHeader)
+	if sent == "" {
+		sent = r.FormValue(csrfField)
+	}
+	if subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) != 1 {
+		return "CSRF token missing or wrong"
+	}
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(c.Value), []byte(sent)) != 1 {
+		return "CSRF cookie doesn't match the token"
+	}
+	return ""
+}
+
+// csrfProtect refuses unsafe requests that fail checkCSRF with 403, unless
+// the protection is switched off.
+func csrfProtect(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if csrfEnabled.Load() {
+			if reason := checkCSRF(r); reason != "" {
+				fmt.Printf("csrf: refused %s %s: %s\n", r.Method, r.URL.Path, reason)
+				http.Error(w, "forbidden: "+reason, http.StatusForbidden)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func csrfPageHandler(w http.ResponseWriter, r *http.Request) {
+	templatePath := filepath.Join("templates", "csrf.html")
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, struct {
+		Enabled   bool
+		CSRFToken string
+	}{csrfEnabled.Load(), csrfToken(w, r)})
+}
+
+// csrfToggleHandler is protected itself, else any site could switch it off.
+func csrfToggleHandler(w http.ResponseWriter, r *http.Request) {
+	csrfEnabled.Store(r.FormValue("enabled") == "on")
+	fmt.Println("csrf protection:", csrfEnabled.Load())
+	w.Header().Set("HX-Refresh", "true")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setupCSRF(mux *http.ServeMux) {
+	csrfEnabled.Store(envOr("CSRF_PROTECTION", "on") != "off")
+	mux.HandleFunc("GET /csrf", csrfPageHandler)
+	mux.HandleFunc("POST /csrf", csrfProtect(csrfToggleHandler))
+}
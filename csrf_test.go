@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	setupSessions(OIDCConfig{})
+	// a page render hands out the token, its session and the cookie
+	page := httptest.NewRecorder()
+	token := csrfToken(page, httptest.NewRequest(http.MethodGet, "/xss", nil))
+	cookies := page.Result().Cookies()
+
+	tests := []struct {
+		name       string
+		method     string
+		site       string // Sec-Fetch-Site
+		withCookie bool   // the session and double-submit cookies
+		token      string
+		wantPass   bool
+	}{
+		{"GET is safe", http.MethodGet, "cross-site", true, "", true},
+		{"cross-site POST", http.MethodPost, "cross-site", true, token, false},
+		{"same-site POST", http.MethodPost, "same-site", true, token, false},
+		{"curl without cookies", http.MethodPost, "", false, "", true},
+		{"same-origin with token", http.MethodPost, "same-origin", true, token, true},
+		{"same-origin without token", http.MethodPost, "same-origin", true, "", false},
+		{"wrong token", http.MethodPost, "same-origin", true, "guessed", false},
+		{"token without the session", http.MethodPost, "same-origin", false, token, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/comments/add", nil)
+		if tt.site != "" {
+			r.Header.Set("Sec-Fetch-Site", tt.site)
+		}
+		if tt.withCookie {
+			for _, c := range cookies {
+				r.AddCookie(c)
+			}
+		}
+		if tt.token != "" {
+			r.Header.Set(csrfHeader, tt.token)
+		}
+		if reason := checkCSRF(r); (reason == "") != tt.wantPass {
+			t.Errorf("%s: refusal %q, want pass=%v", tt.name, reason, tt.wantPass)
+		}
+	}
+}
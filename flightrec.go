@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/metrics"
+	"runtime/trace"
+	"sync"
+	"time"
+)
+
+// The flight recorder keeps the last few seconds of execution trace in
+// memory, so when the server becomes unresponsive under the burners we can
+// dump what happened right before instead of trying to reproduce it.
+var (
+	flightRecorder *trace.FlightRecorder
+
+	flightMu           sync.Mutex
+	lastSnapshot       time.Time
+	lastSnapshotName   string
+	lastSnapshotReason string
+
+	flightWindow         = envDuration("FLIGHT_RECORDER_WINDOW", 10*time.Second)
+	schedP99Threshold    = envDuration("SCHED_P99_THRESHOLD", 50*time.Millisecond)
+	requestSlowThreshold = envDuration("REQUEST_LATENCY_THRESHOLD", 500*time.Millisecond)
+	autoSnapshotCooldown = envDuration("FLIGHT_RECORDER_COOLDOWN", 30*time.Second)
+)
+
+const (
+	schedLatencyMetric    = "/sched/latencies:seconds"
+	schedLatencyPollEvery = time.Second
+)
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		fmt.Printf("invalid %s=%q, using %s: %v\n", key, v, fallback, err)
+		return fallback
+	}
+	return d
+}
+
+// snapshotFlightRecorder writes the recorder's window into traceDir. Automatic
+// snapshots are rate limited, so a spike doesn't fill the disk.
+func snapshotFlightRecorder(reason string, auto bool) (string, error) {
+	if flightRecorder == nil || !flightRecorder.Enabled() {
+		return "", fmt.Errorf("flight recorder not running")
+	}
+
+	flightMu.Lock()
+	defer flightMu.Unlock()
+
+	if auto && time.Since(lastSnapshot) < autoSnapshotCooldown {
+		return "", fmt.Errorf("last snapshot was %s ago", time.Since(lastSnapshot).Round(time.Second))
+	}
+	if err := os.MkdirAll(traceDir, 0o755); err != nil {
+		return "", err
+	}
+	name := "flight-" + time.Now().Format("20060102-150405.000") + ".trace"
+	f, err := os.Create(filepath.Join(traceDir, name))
+	if err != nil {
+		return "", err
+	}
+	if _, err := flightRecorder.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	lastSnapshot = time.Now()
+	lastSnapshotName = name
+	lastSnapshotReason = reason
+	fmt.Println("flight recorder snapshot:", name, "reason:", reason)
+	return name, nil
+}
+
+// histogramP99 returns the upper bound of the bucket holding the 99th percentile
+// of the observations in cur that are not already in prev.
+func histogramP99(prev, cur *metrics.Float64Histogram) (float64, uint64) {
+	var total uint64
+	delta := make([]uint64, len(cur.Counts))
+	for i := range cur.Counts {
+		delta[i] = cur.Counts[i]
+		if prev != nil && i < len(prev.Counts) {
+			delta[i] -= prev.Counts[i]
+		}
+		total += delta[i]
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	rank := uint64(math.Ceil(float64(total) * 0.99))
+	var seen uint64
+	for i, c := range delta {
+		seen += c
+		if seen >= rank {
+			upper := cur.Buckets[i+1]
+			if math.IsInf(upper, 1) {
+				upper = cur.Buckets[i]
+			}
+			return upper, total
+		}
+	}
+	return 0, total
+}
+
+// watchSchedLatency polls the runtime's scheduler latency histogram and
+// snapshots the flight recorder when the p99 of the last interval is too high.
+func watchSchedLatency() {
+	samples := []metrics.Sample{{Name: schedLatencyMetric}}
+	var prev *metrics.Float64Histogram
+
+	ticker := time.NewTicker(schedLatencyPollEvery)
+	defer ticker.Stop()
+	for range ticker.C {
+		metrics.Read(samples)
+		if samples[0].Value.Kind() != metrics.KindFloat64Histogram {
+			return
+		}
+		cur := samples[0].Value.Float64Histogram()
+		// Read may reuse the histogram's memory, keep our own copy
+		snap := &metrics.Float64Histogram{
+			Counts:  append([]uint64(nil), cur.Counts...),
+			Buckets: cur.Buckets,
+		}
+		p99, n := histogramP99(prev, snap)
+		prev = snap
+		if n == 0 {
+			continue
+		}
+		if d := time.Duration(p99 * float64(time.Second)); d > schedP99Threshold {
+			snapshotFlightRecorder(fmt.Sprintf("sched latency p99 %s > %s", d, schedP99Threshold), true)
+		}
+	}
+}
+
+// slowRoutes take long on purpose, a snapshot of each would fill the trace
+// dir and use up the cooldown meant for a real spike.
+var slowRoutes = map[string]bool{
+	"/bench/run":       true,
+	"/transfer/stress": true,
+}
+
+// latencyDecorator snapshots the flight recorder when a request takes longer
+// than requestSlowThreshold.
+func latencyDecorator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slowRoutes[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		if d := time.Since(start); d > requestSlowThreshold {
+			// snapshot in the background, the client shouldn't wait for it
+			go snapshotFlightRecorder(fmt.Sprintf("request %s %s took %s > %s", r.Method, r.URL.Path, d.Round(time.Millisecond), requestSlowThreshold), true)
+		}
+	})
+}
+
+func flightSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := snapshotFlightRecorder("manual", false)
+	if err != nil {
+		http.Error(w, "couldn't snapshot flight recorder: "+err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("HX-Trigger", "tracesChanged")
+	fmt.Fprintf(w, "Saved flight recorder snapshot %s\n", name)
+}
+
+func flightStatusHandler(w http.ResponseWriter, r *http.Request) {
+	flightMu.Lock()
+	name, reason, at := lastSnapshotName, lastSnapshotReason, lastSnapshot
+	flightMu.Unlock()
+
+	enabled := flightRecorder != nil && flightRecorder.Enabled()
+	fmt.Fprintf(w, "<p>flight recorder enabled=%t window=%s sched p99 threshold=%s request threshold=%s</p>",
+		enabled, flightWindow, schedP99Threshold, requestSlowThreshold)
+	if name != "" {
+		fmt.Fprintf(w, "<p>last snapshot: %s at %s (%s)</p>", name, at.Format(time.TimeOnly), template.HTMLEscapeString(reason))
+	}
+}
+
+func setupFlightRecorder(mux *http.ServeMux) {
+	flightRecorder = trace.NewFlightRecorder(trace.FlightRecorderConfig{
+		MinAge: flightWindow,
+	})
+	if err := flightRecorder.Start(); err != nil {
+		fmt.Println("couldn't start flight recorder:", err)
+	} else {
+		fmt.Println("flight recorder running, window:", flightWindow)
+		go watchSchedLatency()
+	}
+
+	mux.HandleFunc("/debug/flightrecorder/snapshot", flightSnapshotHandler)
+	mux.HandleFunc("/debug/flightrecorder/status", flightStatusHandler)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+)
+
+// A gallery of the canonical htmx examples, see https://htmx.org/examples/.
+// Each one is a page in templates/gallery-*.html with its handlers right
+// below, most of them built on the contact store.
+
+const galleryPageSize = 10
+
+// renderGallery executes a gallery page inside the shared layout. Fragment
+// responses pass the name of a template from gallery-rows.html instead.
+func renderGallery(w http.ResponseWriter, page string, status int, data any) {
+	files := []string{
+		filepath.Join("templates", "gallery-layout.html"),
+		filepath.Join("templates", "gallery-rows.html"),
+	}
+	name := "gallery-layout.html"
+	if filepath.Ext(page) == ".html" {
+		files = append(files, filepath.Join("templates", page))
+	} else {
+		name = page
+	}
+	tmpl, err := template.ParseFiles(files...)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+		fmt.Println("render error:", err)
+	}
+}
+
+func galleryIndexHandler(w http.ResponseWriter, r *http.Request) {
+	renderGallery(w, "gallery-index.html", http.StatusOK, len(contacts.List()))
+}
+
+var demoFirstNames = []string{"Ada", "Alan", "Barbara", "Dennis", "Edsger", "Grace", "Ken", "Linus", "Margaret", "Rob"}
+var demoLastNames = []string{"Lovelace", "Turing", "Liskov", "Ritchie", "Dijkstra", "Hopper", "Thompson", "Torvalds", "Hamilton", "Pike"}
+
+// gallerySeedHandler adds 50 demo contacts, so search and scrolling have
+// something to work on.
+func gallerySeedHandler(w http.ResponseWriter, r *http.Request) {
+	for i := range 50 {
+		first, last := demoFirstNames[i%len(demoFirstNames)], demoLastNames[(i/len(demoFirstNames)+i)%len(demoLastNames)]
+		contacts.Create(Contact{
+			FirstName: first,
+			LastName:  last,
+			Email:     fmt.Sprintf("%s.%s%d@example.com", first, last, i),
+			Active:    i%3 != 0,
+		})
+	}
+	w.Header().Set("HX-Trigger", "contactsChanged")
+	fmt.Fprintf(w, "%d contacts", len(contacts.List()))
+}
+
+// Active search: the input searches as you type.
+
+func activeSearchHandler(w http.ResponseWriter, r *http.Request) {
+	renderGallery(w, "gallery-active-search.html", http.StatusOK, nil)
+}
+
+func activeSearchResultsHandler(w http.ResponseWriter, r *http.Request) {
+	found := contacts.Search(r.FormValue("q"))
+	renderGallery(w, "contact-rows", http.StatusOK, found)
+}
+
+// Infinite scroll: the last row loads the next page once it's revealed.
+// Click to load: the same, but a button loads the next page.
+
+type ContactPage struct {
+	Contacts []Contact
+	NextPage int // 0 when this is the last page
+}
+
+func contactPage(r *http.Request) ContactPage {
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	page = max(page, 1)
+	found, more := contacts.Page((page-1)*galleryPageSize, galleryPageSize)
+	p := ContactPage{Contacts: found}
+	if more {
+		p.NextPage = page + 1
+	}
+	return p
+}
+
+func infiniteScrollHandler(w http.ResponseWriter, r *http.Request) {
+	renderGallery(w, "gallery-infinite-scroll.html", http.StatusOK, contactPage(r))
+}
+
+func infiniteScrollRowsHandler(w http.ResponseWriter, r *http.Request) {
+	renderGallery(w, "infinite-scroll-rows", http.StatusOK, contactPage(r))
+}
+
+func clickToLoadHandler(w http.ResponseWriter, r *http.Request) {
+	renderGallery(w, "gallery-click-to-load.html", http.StatusOK, contactPage(r))
+}
+
+func clickToLoadRowsHandler(w http.ResponseWriter, r *http.Request) {
+	renderGallery(w, "click-to-load-rows", http.StatusOK, contactPage(r))
+}
+
+// Bulk update: check rows and (de)activate them all at once.
+
+type BulkRows struct {
+	Contacts []Contact
+	Changed  []int
+}
+
+func (b BulkRows) IsChanged(id int) bool { return slices.Contains(b.Changed, id) }
+
+func bulkUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	renderGallery(w, "gallery-bulk-update.html", http.StatusOK, BulkRows{Contacts: contacts.List()})
+}
+
+func bulkUpdateActiveHandler(w http.ResponseWriter, r *http.Request, active bool) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form data", http.StatusBadRequest)
+		return
+	}
+	var ids []int
+	for _, v := range r.Form["ids"] {
+		if id, err := strconv.Atoi(v); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	changed := contacts.SetActive(ids, active)
+	renderGallery(w, "bulk-rows", http.StatusOK, BulkRows{Contacts: contacts.List(), Changed: changed})
+}
+
+func bulkActivateHandler(w http.ResponseWriter, r *http.Request) {
+	bulkUpdateActiveHandler(w, r, true)
+}
+
+func bulkDeactivateHandler(w http.ResponseWriter, r *http.Request) {
+	bulkUpdateActiveHandler(w, r, false)
+}
+
+// Inline row editing: a row turns into inputs, and back on save or cancel.
+
+func inlineEditHandler(w http.ResponseWriter, r *http.Request) {
+	renderGallery(w, "gallery-inline-edit.html", http.StatusOK, contacts.List())
+}
+
+func inlineEditRowHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := contactFromRequest(w, r)
+	if !ok {
+		return
+	}
+	renderGallery(w, "contact-row", http.StatusOK, c)
+}
+
+func inlineEditFormHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := contactFromRequest(w, r)
+	if !ok {
+		return
+	}
+	renderGallery(w, "contact-row-edit", http.StatusOK, ContactForm{Contact: c})
+}
+
+func inlineEditSaveHandler(w http.ResponseWriter, r *http.Request) {
+	current, ok := contactFromRequest(w, r)
+	if !ok {
+		return
+	}
+	c := contactFromForm(r)
+	c.Id, c.Active = current.Id, current.Active
+	if errs := c.validate(); len(errs) > 0 {
+		renderGallery(w, "contact-row-edit", http.StatusUnprocessableEntity, ContactForm{c, errs})
+		return
+	}
+	if err := contacts.Update(c); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	renderGallery(w, "contact-row", http.StatusOK, c)
+}
+
+// Delete row: the rows delete through DELETE /contact/{id} and fade out.
+
+func deleteRowHandler(w http.ResponseWriter, r *http.Request) {
+	renderGallery(w, "gallery-delete-row.html", http.StatusOK, contacts.List())
+}
+
+// Cascading selects: picking a make loads the models for it.
+
+var carModels = map[string][]string{
+	"Audi":   {"A1", "A4", "A6"},
+	"Toyota": {"Landcruiser", "Tacoma", "Yaris"},
+	"BMW":    {"325i", "325ix", "X5"},
+}
+
+func cascadingSelectsHandler(w http.ResponseWriter, r *http.Request) {
+	makes := make([]string, 0, len(carModels))
+	for m := range carModels {
+		makes = append(makes, m)
+	}
+	slices.Sort(makes)
+	renderGallery(w, "gallery-cascading-selects.html", http.StatusOK, struct {
+		Makes  []string
+		Models []string
+	}{makes, carModels[makes[0]]})
+}
+
+func cascadingModelsHandler(w http.ResponseWriter, r *http.Request) {
+	models, ok := carModels[r.FormValue("make")]
+	if !ok {
+		http.Error(w, "unknown make", http.StatusBadRequest)
+		return
+	}
+	renderGallery(w, "model-options", http.StatusOK, models)
+}
+
+func setupGallery(mux *http.ServeMux) {
+	mux.HandleFunc("GET /gallery", galleryIndexHandler)
+	mux.HandleFunc("POST /gallery/seed", gallerySeedHandler)
+
+	mux.HandleFunc("GET /gallery/active-search", activeSearchHandler)
+	mux.HandleFunc("POST /gallery/active-search", activeSearchResultsHandler)
+
+	mux.HandleFunc("GET /gallery/infinite-scroll", infiniteScrollHandler)
+	mux.HandleFunc("GET /gallery/infinite-scroll/rows", infiniteScrollRowsHandler)
+
+	mux.HandleFunc("GET /gallery/click-to-load", clickToLoadHandler)
+	mux.HandleFunc("GET /gallery/click-to-load/rows", clickToLoadRowsHandler)
+
+	mux.HandleFunc("GET /gallery/bulk-update", bulkUpdateHandler)
+	mux.HandleFunc("PUT /gallery/bulk-update/activate", bulkActivateHandler)
+	mux.HandleFunc("PUT /gallery/bulk-update/deactivate", bulkDeactivateHandler)
+
+	mux.HandleFunc("GET /gallery/inline-edit", inlineEditHandler)
+	mux.HandleFunc("GET /gallery/inline-edit/{id}", inlineEditRowHandler)
+	mux.HandleFunc("GET /gallery/inline-edit/{id}/edit", inlineEditFormHandler)
+	mux.HandleFunc("PUT /gallery/inline-edit/{id}", inlineEditSaveHandler)
+
+	mux.HandleFunc("GET /gallery/delete-row", deleteRowHandler)
+
+	mux.HandleFunc("GET /gallery/cascading-selects", cascadingSelectsHandler)
+	mux.HandleFunc("GET /gallery/cascading-selects/models", cascadingModelsHandler)
+}
@@ -5,6 +5,7 @@ go 1.25.4
 require (
 	github.com/coreos/go-oidc/v3 v3.17.0
 	github.com/gorilla/sessions v1.4.0
+	golang.org/x/net v0.58.0
 	golang.org/x/oauth2 v0.34.0
 )
 
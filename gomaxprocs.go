@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Where the current GOMAXPROCS value came from. Since go 1.25 the runtime
+// default honors the cgroup CPU limit, which is what the container demos are about.
+const (
+	gomaxprocsFromDefault = "default"
+	gomaxprocsFromEnv     = "env"
+	gomaxprocsFromManual  = "manual"
+)
+
+var (
+	gomaxprocsMu     sync.Mutex
+	gomaxprocsSource = initialGomaxprocsSource()
+)
+
+func initialGomaxprocsSource() string {
+	if v, ok := os.LookupEnv("GOMAXPROCS"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return gomaxprocsFromEnv
+		}
+	}
+	return gomaxprocsFromDefault
+}
+
+// maxGomaxprocs bounds manual overrides. Going past the CPU count is allowed,
+// so oversubscribing can be demoed, but not to nonsensical values.
+func maxGomaxprocs() int {
+	return 4 * runtime.NumCPU()
+}
+
+func setGomaxprocs(n int) (int, error) {
+	gomaxprocsMu.Lock()
+	defer gomaxprocsMu.Unlock()
+	return setGomaxprocsLocked(n)
+}
+
+// adjustGomaxprocs changes GOMAXPROCS by delta. Reading the current value
+// under the lock too means two concurrent clicks can't lose one.
+func adjustGomaxprocs(delta int) (int, error) {
+	gomaxprocsMu.Lock()
+	defer gomaxprocsMu.Unlock()
+	return setGomaxprocsLocked(runtime.GOMAXPROCS(0) + delta)
+}
+
+// setGomaxprocsLocked must be called with gomaxprocsMu held.
+func setGomaxprocsLocked(n int) (int, error) {
+	if n < 1 || n > maxGomaxprocs() {
+		return 0, fmt.Errorf("GOMAXPROCS must be between 1 and %d, got %d", maxGomaxprocs(), n)
+	}
+	runtime.GOMAXPROCS(n)
+	gomaxprocsSource = gomaxprocsFromManual
+	return n, nil
+}
+
+// resetGomaxprocs hands control back to the runtime, which derives the value
+// from the cgroup limit and CPU count, ignoring the GOMAXPROCS env var.
+func resetGomaxprocs() int {
+	gomaxprocsMu.Lock()
+	defer gomaxprocsMu.Unlock()
+	runtime.SetDefaultGOMAXPROCS()
+	gomaxprocsSource = gomaxprocsFromDefault
+	return runtime.GOMAXPROCS(0)
+}
+
+// cgroupCPULimit returns the CPU quota from cpu.max, or 0 when there is none.
+func cgroupCPULimit() float64 {
+	contents, err := os.ReadFile("/sys/fs/cgroup/cpu.max")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(contents))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0
+	}
+	quota, err1 := strconv.ParseFloat(fields[0], 64)
+	period, err2 := strconv.ParseFloat(fields[1], 64)
+	if err1 != nil || err2 != nil || period == 0 {
+		return 0
+	}
+	return quota / period
+}
+
+// gomaxprocsSourceString explains the current value for the load page.
+func gomaxprocsSourceString() string {
+	gomaxprocsMu.Lock()
+	source := gomaxprocsSource
+	gomaxprocsMu.Unlock()
+
+	switch source {
+	case gomaxprocsFromEnv:
+		return "GOMAXPROCS env var (" + os.Getenv("GOMAXPROCS") + ")"
+	case gomaxprocsFromManual:
+		return "manual override"
+	}
+	if limit := cgroupCPULimit(); limit > 0 && limit < float64(runtime.NumCPU()) {
+		return fmt.Sprintf("runtime default from cgroup limit (%.2f CPUs)", limit)
+	}
+	return "runtime default from CPU count"
+}
+
+func threadsSetHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.FormValue("n"))
+	if err != nil {
+		http.Error(w, "n must be an integer", http.StatusBadRequest)
+		return
+	}
+	if _, err := setGomaxprocs(n); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("HX-Trigger", "stateChanged")
+	fmt.Fprintf(w, "Set GOMAXPROCS to %d", n)
+}
+
+func threadsResetHandler(w http.ResponseWriter, r *http.Request) {
+	n := resetGomaxprocs()
+	w.Header().Set("HX-Trigger", "stateChanged")
+	fmt.Fprintf(w, "Reset GOMAXPROCS to runtime default %d", n)
+}
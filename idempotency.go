@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Money-moving requests may carry an Idempotency-Key header. The first
+// response for a key is remembered, and a retry with the same key gets that
+// response replayed instead of moving the money a second time. Keys are
+// only unique per session: the response may hold the session's CSRF token,
+// another client must never get it replayed.
+
+const (
+	idempotencyTTL     = 24 * time.Hour
+	maxIdempotencyKeys = 10000
+)
+
+type idempotentResponse struct {
+	done        chan struct{} // closed once the first request finished
+	fingerprint string
+	createdAt   time.Time
+	status      int
+	header      http.Header
+	body        []byte
+}
+
+var (
+	idempotencyMu   sync.Mutex
+	idempotencyKeys = map[string]*idempotentResponse{}
+)
+
+// responseRecorder captures a response, so it can be stored and replayed.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) Header() http.Header { return rec.header }
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(b)
+}
+
+func (resp *idempotentResponse) writeTo(w http.ResponseWriter) {
+	for k, v := range resp.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
+
+// expireIdempotencyKeys drops old entries. Caller must hold idempotencyMu.
+func expireIdempotencyKeys() {
+	for key, resp := range idempotencyKeys {
+		select {
+		case <-resp.done:
+			if time.Since(resp.createdAt) > idempotencyTTL {
+				delete(idempotencyKeys, key)
+			}
+		default:
+		}
+	}
+}
+
+// evictOldestIdempotencyKey makes room for a new entry, it reports false
+// if every entry is still in flight. Caller must hold idempotencyMu.
+func evictOldestIdempotencyKey() bool {
+	var oldestKey string
+	var oldest *idempotentResponse
+	for key, resp := range idempotencyKeys {
+		select {
+		case <-resp.done:
+			if oldest == nil || resp.createdAt.Before(oldest.createdAt) {
+				oldestKey, oldest = key, resp
+			}
+		default:
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(idempotencyKeys, oldestKey)
+	return true
+}
+
+// idempotencySession identifies the client by the session its page was
+// rendered with, "" without one.
+func idempotencySession(r *http.Request) string {
+	session, _ := store.Get(r, "csrf")
+	token, _ := session.Values["token"].(string)
+	if token == "" {
+		return ""
+	}
+	// the token is a secret, don't keep it around as a map key
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotent wraps a handler so requests with an Idempotency-Key are applied
+// at most once. Reusing a key with a different form is refused with 422.
+// Without a session, like curl without a cookie jar, the key alone is the
+// scope: the client's random key is all that tells it apart.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		sid := idempotencySession(r)
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "invalid form data", http.StatusBadRequest)
+			return
+		}
+		scoped := sid + " " + r.Method + " " + r.URL.Path + " " + key
+		fingerprint := r.Form.Encode()
+
+		idempotencyMu.Lock()
+		expireIdempotencyKeys()
+		resp, seen := idempotencyKeys[scoped]
+		if !seen && len(idempotencyKeys) >= maxIdempotencyKeys && !evictOldestIdempotencyKey() {
+			idempotencyMu.Unlock()
+			http.Error(w, "too many requests in flight, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		if !seen {
+			resp = &idempotentResponse{done: make(chan struct{}), fingerprint: fingerprint, createdAt: time.Now()}
+			idempotencyKeys[scoped] = resp
+		}
+		idempotencyMu.Unlock()
+
+		if seen {
+			// a concurrent retry waits for the original to finish
+			<-resp.done
+			if resp.fingerprint != fingerprint {
+				http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			resp.writeTo(w)
+			return
+		}
+
+		rec := &responseRecorder{header: http.Header{}}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		resp.status, resp.header, resp.body = rec.status, rec.header, rec.body.Bytes()
+		if sid == "" {
+			// the session the handler started is this client's, a replay
+			// mustn't hand it to whoever else knows the key
+			resp.header = rec.header.Clone()
+			resp.header.Del("Set-Cookie")
+		}
+		close(resp.done)
+		first := idempotentResponse{status: rec.status, header: rec.header, body: resp.body}
+		first.writeTo(w)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func postWithKey(h http.HandlerFunc, key string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/account/1/deposits", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestIdempotentReplaysWithoutCookies(t *testing.T) {
+	setupSessions(OIDCConfig{})
+	idempotencyMu.Lock()
+	idempotencyKeys = map[string]*idempotentResponse{}
+	idempotencyMu.Unlock()
+	calls := 0
+	h := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.SetCookie(w, &http.Cookie{Name: "csrf", Value: "first client's"})
+		w.Write([]byte("booked"))
+	})
+	form := url.Values{"amount": {"10"}}
+
+	first := postWithKey(h, "no-cookies-key", form)
+	second := postWithKey(h, "no-cookies-key", form)
+	if calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls)
+	}
+	if first.Header().Get("Set-Cookie") == "" {
+		t.Error("the first response lost its cookie")
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" || second.Body.String() != "booked" {
+		t.Errorf("second response wasn't replayed: %v %q", second.Header(), second.Body)
+	}
+	if second.Header().Get("Set-Cookie") != "" {
+		t.Error("the replay handed out the first client's cookie")
+	}
+
+	other := postWithKey(h, "no-cookies-key", url.Values{"amount": {"20"}})
+	if other.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reusing the key for another form: got %d, want 422", other.Code)
+	}
+	postWithKey(h, "another-key", form)
+	if calls != 2 {
+		t.Errorf("a new key wasn't applied, handler ran %d times", calls)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -20,16 +21,8 @@ import (
 	//
 )
 
-type Comment struct {
-	Author    string
-	Content   template.HTML // to show stored XSS, else "string" is better
-	CreatedAt time.Time
-}
-
 var (
-	comments []Comment = []Comment{
-		//{Author: "Bob", Content: "Nice website!", CreatedAt: time.Now()},
-	}
+	comments *CommentStore
 )
 
 func httpbin(w http.ResponseWriter, r *http.Request) {
@@ -86,69 +79,6 @@ func foo(w http.ResponseWriter, r *http.Request) {
 // HTMX refuses to make AJAX requests from `file://` and will throw the error "htmx:invalidPath"
 // so we need to serve the inital file from this webserver
 
-type BankAccount struct {
-	Id      int
-	Balance int
-}
-
-var (
-	MyAccount BankAccount
-)
-
-// works
-func accountTest(w http.ResponseWriter, r *http.Request) {
-	str := fmt.Sprintf("<b>Account: %d Deposit: %d</b>", MyAccount.Id, MyAccount.Balance)
-	w.Write([]byte(str))
-}
-
-func account(w http.ResponseWriter, r *http.Request) {
-	// parse tmeplate
-	tmplPath := filepath.Join("templates", "account.html")
-	tmpl, err := template.ParseFiles(tmplPath)
-	if err != nil {
-		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
-	}
-
-	// here usually fetch accoutn account, by we're using the global one
-	data := MyAccount
-
-	if err := tmpl.Execute(w, data); err != nil {
-		http.Error(w, "render error:"+err.Error(), http.StatusInternalServerError)
-	}
-}
-
-// Because this Handler returns HTML with embeded hypermedia control
-// this is a hypermedia API and the golang server a hypermedia server
-// and this API truely RESTful!
-func withdrawal(w http.ResponseWriter, r *http.Request) {
-	MyAccount.Balance -= 5
-	account(w, r)
-}
-
-func deposits(w http.ResponseWriter, r *http.Request) {
-	MyAccount.Balance += 5
-	account(w, r)
-}
-
-func testEditThing(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte(`<form hx-put="/contact/1" hx-target="this" hx-swap="outerHTML">
-  <div>
-    <label>First Name</label>
-    <input type="text" name="firstName" value="Joe">
-  </div>
-  <div class="form-group">
-    <label>Last Name</label>
-    <input type="text" name="lastName" value="Blow">
-  </div>
-  <div class="form-group">
-    <label>Email Address</label>
-    <input type="email" name="email" value="joe@blow.com">
-  </div>
-  <button class="btn" type="submit">Submit</button>
-  <button class="btn" hx-get="/contact/1">Cancel</button>
-</form>`))
-}
-
 func loggingDecorator(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("Request path:", r.URL.Path)
@@ -160,6 +90,7 @@ func proc(w http.ResponseWriter, r *http.Request) {
 	gomaxprocs := strconv.Itoa(runtime.GOMAXPROCS(0))
 	numCPU := strconv.Itoa(runtime.NumCPU())
 	fmt.Fprintf(w, "<p>gomaxprocs=%s numCPU=%s</p>", gomaxprocs, numCPU)
+	fmt.Fprintf(w, "<p>source: %s</p>", gomaxprocsSourceString())
 }
 
 func procLimit(w http.ResponseWriter, r *http.Request) {
@@ -302,19 +233,23 @@ func threadsViewHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func threadsIncreaseHandler(w http.ResponseWriter, r *http.Request) {
-	currentGomaxprocs := runtime.GOMAXPROCS(0)
-	currentGomaxprocs++
-	runtime.GOMAXPROCS(currentGomaxprocs)
+	n, err := adjustGomaxprocs(1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	w.Header().Set("HX-Trigger", "stateChanged")
-	io.WriteString(w, fmt.Sprintf("Started 1 more CPU load goroutine: %s", currentGomaxprocs))
+	fmt.Fprintf(w, "Increased GOMAXPROCS to %d", n)
 }
 
 func threadsDecreaseHandler(w http.ResponseWriter, r *http.Request) {
-	currentGomaxprocs := runtime.GOMAXPROCS(0)
-	currentGomaxprocs--
-	runtime.GOMAXPROCS(currentGomaxprocs)
+	n, err := adjustGomaxprocs(-1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	w.Header().Set("HX-Trigger", "stateChanged")
-	io.WriteString(w, fmt.Sprintf("Started 1 more CPU load goroutine: %s", currentGomaxprocs))
+	fmt.Fprintf(w, "Decreased GOMAXPROCS to %d", n)
 }
 
 func xssExampleHandler(w http.ResponseWriter, r *http.Request) {
@@ -323,7 +258,13 @@ func xssExampleHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
 	}
-	tmpl.Execute(w, nil)
+	tmpl.Execute(w, struct {
+		Mode      string
+		Modes     []string
+		Nonce     string
+		CSPPolicy string
+		CSRFToken string
+	}{commentMode(r), commentModes, cspNonce(r), currentCSPPolicy(), csrfToken(w, r)})
 }
 
 func xssCommentHandler(w http.ResponseWriter, r *http.Request) {
@@ -333,7 +274,11 @@ func xssCommentHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
 	}
-	tmpl.Execute(w, comments)
+	mode := commentMode(r)
+	tmpl.Execute(w, struct {
+		Mode     string
+		Comments []RenderedComment
+	}{mode, renderComments(comments.List(), mode)})
 }
 
 func addCommentHandler(w http.ResponseWriter, r *http.Request) {
@@ -356,13 +301,12 @@ func addCommentHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	comment := Comment{
-		Author:    "Anonymous", // derive later from ID TOKEN!
-		Content:   template.HTML(content),
+		Author:    actorFromRequest(r),
+		Content:   content,
 		CreatedAt: time.Now(),
 	}
-	// actually racy, you should use a lock on the comments slice! Is this a perfect
-	// example of this being a best fit for Mutex vs go channels?
-	comments = append(comments, comment)
+	// the store guards the comments with a mutex, several people may post at once
+	comments.Add(comment)
 
 	// We're done here, we're not returning a body, all this endpoint does it mutate server
 	// state. This post doesn't responsd with any HTML. For that the /comment endpoint is used!
@@ -372,12 +316,25 @@ func addCommentHandler(w http.ResponseWriter, r *http.Request) {
 func popCommentHandler(w http.ResponseWriter, r *http.Request) {
 	// we use this htmx trigger to autoload the newly added comment!
 	w.Header().Add("HX-Trigger", "commentsUpdate")
-	if !(len(comments) >= 1) {
-		w.WriteHeader(http.StatusNoContent)
+	comments.Pop()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	comments = comments[0 : len(comments)-1]
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := comments.Delete(id); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Add("HX-Trigger", "commentsUpdate")
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -485,19 +442,6 @@ func dateSiteHandler(w http.ResponseWriter, r *http.Request) {
 	err = tmpl.Execute(w, nil)
 }
 
-func corsExampleHandler(w http.ResponseWriter, r *http.Request) {
-	// disable CORS
-	w.Header().Add("Access-Control-Allow-Origin", "*")
-
-	templatePath := filepath.Join("templates", "cors-example.html")
-	tmpl, err := template.ParseFiles(templatePath)
-	if err != nil {
-		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
-	}
-	tmpl.Execute(w, nil)
-
-}
-
 // jsonHandler just returns some json for SOP tests
 func jsonHandler(w http.ResponseWriter, r *http.Request) {
 	// if r.Method != http.MethodGet {
@@ -515,9 +459,11 @@ func jsonHandler(w http.ResponseWriter, r *http.Request) {
 
 	_, ok := r.URL.Query()["cors"]
 	if ok {
-		// Cores header set!
-		w.Header().Set("Access-Control-Allow-Origin", "*") // allow all!
-		fmt.Println("/json CORS flag set -> setting CORS header for responses!")
+		// CORS only with the flag, the SOP page compares both
+		fmt.Println("/json CORS flag set -> applying the public CORS policy!")
+		if handleCORS(w, r, publicCORS) {
+			return
+		}
 	}
 
 	// 2. Set the Content-Type header BEFORE writing status or body
@@ -536,6 +482,12 @@ func jsonHandler(w http.ResponseWriter, r *http.Request) {
 func main() {
 	startupMessages()
 
+	oidcConfig, err := loadOIDCConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	setupSessions(oidcConfig)
+
 	mux := http.NewServeMux()
 
 	// serve statis files from ./static !
@@ -555,39 +507,50 @@ func main() {
 	mux.HandleFunc("/threads/view", threadsViewHandler)
 	mux.HandleFunc("/threads/increase", threadsIncreaseHandler)
 	mux.HandleFunc("/threads/decrease", threadsDecreaseHandler)
+	mux.HandleFunc("/threads/set", threadsSetHandler)
+	mux.HandleFunc("/threads/reset", threadsResetHandler)
 
 	mux.HandleFunc("/metrics/sched", serveAllSchedMetrics)
+	mux.HandleFunc("/metrics/probe", schedProbeHandler)
+	go runSchedProbe()
+
+	setupTrace(mux)
+	setupFlightRecorder(mux)
 
 	mux.HandleFunc("/httpbin", httpbin)
 	mux.HandleFunc("/foo", foo)
 
-	MyAccount = BankAccount{
-		Id:      12345,
-		Balance: 100,
-	}
-
-	mux.HandleFunc("/accountTest", accountTest)
-
-	mux.HandleFunc("/account", account)
+	setupAccounts(mux)
 
-	mux.HandleFunc("/account/12345/deposits", deposits)
-	mux.HandleFunc("/account/12345/withdrawal", withdrawal)
-
-	mux.HandleFunc("/contact/1/edit", testEditThing)
+	setupContacts(mux)
+	setupGallery(mux)
 
 	mux.HandleFunc("/proc", proc)
 
 	mux.HandleFunc("/proc/limit", procLimit)
+	mux.HandleFunc("/proc/timeline", timelineHandler)
+	go watchGomaxprocs()
 
 	// Test XSS
-	mux.HandleFunc("/xss", xssExampleHandler)
+	comments, err = NewCommentStore(envOr("COMMENTS_FILE", filepath.Join("nfs", "comments.json")))
+	if err != nil {
+		fmt.Println("couldn't load comments, starting empty:", err)
+		comments, _ = NewCommentStore("")
+	}
+	// the XSS lab is served under the selected Content-Security-Policy
+	mux.Handle("/xss", cspDecorator(http.HandlerFunc(xssExampleHandler)))
 	mux.HandleFunc("/comments", xssCommentHandler)
-	mux.HandleFunc("/comments/add", addCommentHandler)
-	mux.HandleFunc("/comments/pop", popCommentHandler)
+	mux.HandleFunc("/comments/add", csrfProtect(addCommentHandler))
+	mux.HandleFunc("/comments/pop", csrfProtect(popCommentHandler))
+	mux.HandleFunc("/comments/mode", csrfProtect(commentModeHandler))
+	mux.HandleFunc("/comments/{id}", csrfProtect(deleteCommentHandler))
 
-	mux.HandleFunc("/echo", echoHandler)
+	mux.Handle("/echo", cspDecorator(http.HandlerFunc(echoHandler)))
+	setupCSP(mux)
+	setupReflect(mux)
+	setupCSRF(mux)
 
-	mux.HandleFunc("/cors", corsExampleHandler)
+	setupCORS(mux)
 	mux.HandleFunc("/ajax", ajaxExampleHandler)
 
 	mux.HandleFunc("/date", dateHandler)
@@ -596,19 +559,30 @@ func main() {
 	mux.HandleFunc("/json", jsonHandler)
 	mux.HandleFunc("/sop", sopExampleHandler)
 
-	loggingMux := loggingDecorator(mux)
+	mux.HandleFunc("/bench", benchPageHandler)
+	mux.HandleFunc("/bench/run", benchRunHandler)
+
+	loggingMux := loggingDecorator(latencyDecorator(mux))
 
-	// oauth
-	//SetupOauth(mux)
+	// oauth, when configured
+	mux.HandleFunc("/me", meHandler)
+	if oidcConfig.Enabled() {
+		SetupOauth(mux, oidcConfig)
+		fmt.Println("OIDC login enabled, issuer:", oidcConfig.Issuer)
+	} else {
+		fmt.Println("OIDC not configured, set OIDC_ISSUER to enable /login")
+	}
 
 	// Listen port
 	port, ok := os.LookupEnv("PORT")
 	if !ok {
 		port = "5000"
 	}
+	listenPort = port
 	port = ":" + port
+	startAttacker()
 	fmt.Println("Listening on", port)
-	err := http.ListenAndServe(port, loggingMux)
+	err = http.ListenAndServe(port, loggingMux)
 	if err != nil {
 		panic(err)
 	}
@@ -4,10 +4,15 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/gob"
 	"fmt"
+	"html/template"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/gorilla/sessions"
@@ -17,21 +22,55 @@ import (
 var (
 	ctx = context.Background()
 
-	// keycloak server
-	keycloakIssuer = "http://localhost:8080/realms/myrealm"
-	clientID       = "gosrv"
-	// where?
-	clientSecret = "CLIENT_SECRET"
-	redirectURL  = "http://localhost:5000/callback"
-
-	// globals
+	// globals, the keycloak server and client come from the OIDCConfig
 	oauth2Config oauth2.Config
 	verifier     *oidc.IDTokenVerifier
+	oidcEnabled  bool
+
+	// the provider's logout, "" if it has none
+	endSessionEndpoint string
 
-	// Cookie-based session store
-	store = sessions.NewCookieStore([]byte("dev-secret-CHANGE-ME"))
+	// Cookie-based session store, signed with the SESSION_KEY
+	store *sessions.CookieStore
+
+	// how long a login lasts
+	sessionMaxAge = envDuration("SESSION_MAX_AGE", 8*time.Hour)
 )
 
+// SessionUser is who logged in, kept in the "auth" session.
+type SessionUser struct {
+	Subject   string
+	Name      string
+	Email     string
+	ExpiresAt time.Time
+}
+
+func init() {
+	// the session cookie is gob encoded, custom types must be registered
+	gob.Register(SessionUser{})
+}
+
+// currentUser returns the logged in user, if the session hasn't expired.
+func currentUser(r *http.Request) (SessionUser, bool) {
+	session, _ := store.Get(r, "auth")
+	user, ok := session.Values["user"].(SessionUser)
+	if !ok || time.Now().After(user.ExpiresAt) {
+		return SessionUser{}, false
+	}
+	return user, true
+}
+
+// DisplayName is how the user shows up as author or actor.
+func (u SessionUser) DisplayName() string {
+	if u.Name != "" {
+		return u.Name
+	}
+	if u.Email != "" {
+		return u.Email
+	}
+	return u.Subject
+}
+
 func randomState() string {
 	b := make([]byte, 32)
 	_, _ = rand.Read(b)
@@ -42,13 +81,22 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("SomeHeader", "Foobar")
 	state := randomState()
 
-	// THIS creates the Cookie header! And it is necessary in sofar
-	// as we need the state in the state header to be set!!
+	// PKCE: only who holds the verifier can exchange the code, so an
+	// intercepted code is useless. Keycloak gets the S256 challenge now,
+	// the verifier itself only on the exchange.
+	pkceVerifier := oauth2.GenerateVerifier()
+	// the nonce comes back inside the ID token, binding it to this login
+	nonce := randomState()
+
 	session, _ := store.Get(r, "auth")
 	session.Values["state"] = state
+	session.Values["pkce_verifier"] = pkceVerifier
+	session.Values["nonce"] = nonce
+	// THIS creates the Cookie header! And it is necessary in sofar
+	// as we need the state in the state header to be set!!
 	session.Save(r, w)
 
-	url := oauth2Config.AuthCodeURL(state)
+	url := oauth2Config.AuthCodeURL(state, oauth2.S256ChallengeOption(pkceVerifier), oidc.Nonce(nonce))
 	// redirecting to Keycloak, starting the Auth flow
 
 	// code http.StatusFound: this is fully intended redirection, not because the site has
@@ -71,27 +119,45 @@ func handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("handleOAuth2Callback: verify state failed. request state=%v, session.values[\"state\"]=%v \n", r.URL.Query().Get("state"), session.Values["state"])
 		return
 	}
+	// the state, verifier and nonce are single use
+	pkceVerifier, _ := session.Values["pkce_verifier"].(string)
+	nonce, _ := session.Values["nonce"].(string)
+	delete(session.Values, "state")
+	delete(session.Values, "pkce_verifier")
+	delete(session.Values, "nonce")
+	if pkceVerifier == "" || nonce == "" {
+		http.Error(w, "login failed, no login in progress", http.StatusBadRequest)
+		return
+	}
+
 	// Verify state and errors.
-	oauth2Token, err := oauth2Config.Exchange(ctx, r.URL.Query().Get("code"))
+	oauth2Token, err := oauth2Config.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(pkceVerifier))
 	if err != nil {
-		fmt.Println("FATAL: handleOAuth2Callback: oauth2configexchange failed. Err:", err)
-		return // fatal error so we must return
+		fmt.Println("handleOAuth2Callback: oauth2configexchange failed. Err:", err)
+		http.Error(w, "login failed, couldn't exchange the code", http.StatusBadGateway)
+		return
 	}
 
 	// Extract the ID Token from OAuth2 token.
 	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
 	if !ok {
-		// handle missing token
-		fmt.Println("FATAL: handleOAuth2Callback: TODO handle missing token. Err:", err)
-		return // fatal error so we must return
+		fmt.Println("handleOAuth2Callback: no id_token in the token response")
+		http.Error(w, "login failed, the provider sent no ID token", http.StatusBadGateway)
+		return
 	}
 
 	// Parse and verify ID Token payload.
 	idToken, err := verifier.Verify(r.Context(), rawIDToken)
 	if err != nil {
-		// handle error
-		fmt.Println("FATAL: handleOAuth2Callback: TODO parse and verify ID token payloa. Err:", err)
-		return // fatal error so we must return
+		fmt.Println("handleOAuth2Callback: verifying the ID token failed. Err:", err)
+		http.Error(w, "login failed, invalid ID token", http.StatusBadGateway)
+		return
+	}
+	// a replayed ID token carries the nonce of another login
+	if idToken.Nonce != nonce {
+		fmt.Printf("handleOAuth2Callback: nonce mismatch. token nonce=%q, session nonce=%q\n", idToken.Nonce, nonce)
+		http.Error(w, "login failed, ID token nonce doesn't match", http.StatusBadRequest)
+		return
 	}
 
 	// Extract custom claims
@@ -99,17 +165,91 @@ func handleOAuth2Callback(w http.ResponseWriter, r *http.Request) {
 	var claims struct {
 		Email    string `json:"email"`
 		Verified bool   `json:"email_verified"`
+		Name     string `json:"name"`
 	}
 	if err := idToken.Claims(&claims); err != nil {
-		// handle error
-		fmt.Println("handleOAuth2Callback: TODO handling idtoken.Claims error. Err:", err)
+		fmt.Println("handleOAuth2Callback: couldn't parse the ID token claims. Err:", err)
 	}
 
-	fmt.Println("handleOAuth2Callback: Maybe reached end of oauthflow successfully. Claims:", claims)
-	io.WriteString(w, fmt.Sprintf("%v <br>", claims))
-	// this sholud return the full raw JWT (Oauth OIDC ID TOKEN)
-	io.WriteString(w, fmt.Sprintf("rawIDToken: %v", rawIDToken))
+	// the login lasts SESSION_MAX_AGE, however long the tokens do
+	user := SessionUser{
+		Subject:   idToken.Subject,
+		Name:      claims.Name,
+		Email:     claims.Email,
+		ExpiresAt: time.Now().Add(sessionMaxAge),
+	}
+	session.Values["user"] = user
+	// the tokens stay on the server, the cookie only gets their id. The ID
+	// token is needed there too, as id_token_hint on logout
+	sid := randomState()
+	saveUserTokens(sid, newUserTokens(oauth2Token, rawIDToken))
+	session.Values["sid"] = sid
+	session.Options.MaxAge = int(sessionMaxAge.Seconds())
+	if err := session.Save(r, w); err != nil {
+		fmt.Println("handleOAuth2Callback: couldn't save the session. Err:", err)
+		http.Error(w, "login failed, couldn't save the session", http.StatusInternalServerError)
+		return
+	}
 
+	fmt.Printf("handleOAuth2Callback: logged in %s (%s) until %s\n", user.DisplayName(), user.Subject, user.ExpiresAt.Format(time.RFC3339))
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// meHandler is the fragment for the page header: who's logged in, or a login link.
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	templatePath := filepath.Join("templates", "me.html")
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	user, ok := currentUser(r)
+	tmpl.Execute(w, struct {
+		User        SessionUser
+		LoggedIn    bool
+		OIDCEnabled bool
+		CSRFToken   string // for the logout form
+	}{user, ok, oidcEnabled, csrfToken(w, r)})
+}
+
+// logoutHandler ends our session, and then the provider's, so the next
+// login asks for the password again.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "auth")
+	var idToken string
+	if ut, err := tokensFromRequest(r); err == nil {
+		// the latest, a refresh may have brought a newer one
+		ut.mu.Lock()
+		idToken = ut.rawIDToken
+		ut.mu.Unlock()
+	}
+	if sid, ok := session.Values["sid"].(string); ok {
+		deleteUserTokens(sid)
+	}
+	session.Values = map[any]any{}
+	session.Options.MaxAge = -1
+	if err := session.Save(r, w); err != nil {
+		fmt.Println("logoutHandler: couldn't clear the session. Err:", err)
+	}
+
+	if endSessionEndpoint == "" || idToken == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	u, err := url.Parse(endSessionEndpoint)
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	// back to our index page, it must be allowed at the provider like the redirect URL
+	home, _ := url.Parse(oauth2Config.RedirectURL)
+	home.Path, home.RawQuery = "/", ""
+	q := u.Query()
+	q.Set("id_token_hint", idToken)
+	q.Set("client_id", oauth2Config.ClientID)
+	q.Set("post_logout_redirect_uri", home.String())
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
 }
 
 // testing if we can set cookies willy-nilly
@@ -121,26 +261,40 @@ func setMyCookie(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, fmt.Sprintf("attempted to set cookie in your browser setting the following header on this Response:<br> Set-Cookie: %v", cookie))
 }
 
-func SetupOauth(mux *http.ServeMux) {
-	provider, err := oidc.NewProvider(ctx, keycloakIssuer)
+func SetupOauth(mux *http.ServeMux, cfg OIDCConfig) {
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("OIDC discovery at %s failed: %v", cfg.Issuer, err)
 	}
 
 	oauth2Config = oauth2.Config{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		RedirectURL:  redirectURL,
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		RedirectURL:  cfg.RedirectURL,
 		Endpoint:     provider.Endpoint(),
 		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
 	}
 
 	verifier = provider.Verifier(&oidc.Config{
-		ClientID: clientID,
+		ClientID: cfg.ClientID,
 	})
 
+	var discovery struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := provider.Claims(&discovery); err != nil {
+		fmt.Println("SetupOauth: couldn't read the provider metadata. Err:", err)
+	}
+	endSessionEndpoint = discovery.EndSessionEndpoint
+	oidcEnabled = true
+
 	mux.HandleFunc("/login", loginHandler)
 	mux.HandleFunc("/callback", handleOAuth2Callback)
+	// POST, else any page could log the user out with an <img>
+	mux.HandleFunc("POST /logout", csrfProtect(logoutHandler))
+	mux.HandleFunc("GET /auth/debug", authDebugHandler)
+	mux.HandleFunc("GET /auth/debug/tokens", authDebugTokensHandler)
+	mux.HandleFunc("POST /auth/debug/refresh", csrfProtect(authDebugRefreshHandler))
 
 	mux.HandleFunc("/setcookie", setMyCookie)
 
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// OIDCConfig is the login through Keycloak, or any OIDC provider. Every
+// value can come from the secret file, e.g. a mounted Kubernetes secret,
+// be overridden by its env var, and that by its flag.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	SessionKey   string // signs the session cookies
+}
+
+const minSessionKeyLen = 32
+
+var oidcSettings = []struct {
+	env, flag, usage string
+	field            func(c *OIDCConfig) *string
+}{
+	{"OIDC_ISSUER", "oidc-issuer", "OIDC issuer URL, like http://localhost:8080/realms/myrealm", func(c *OIDCConfig) *string { return &c.Issuer }},
+	{"OIDC_CLIENT_ID", "oidc-client-id", "OIDC client ID", func(c *OIDCConfig) *string { return &c.ClientID }},
+	{"OIDC_CLIENT_SECRET", "oidc-client-secret", "OIDC client secret, better kept in the secret file", func(c *OIDCConfig) *string { return &c.ClientSecret }},
+	{"OIDC_REDIRECT_URL", "oidc-redirect-url", "where the provider sends users back to, like http://localhost:5000/callback", func(c *OIDCConfig) *string { return &c.RedirectURL }},
+	{"SESSION_KEY", "session-key", fmt.Sprintf("key signing the session cookies, at least %d bytes", minSessionKeyLen), func(c *OIDCConfig) *string { return &c.SessionKey }},
+}
+
+// Enabled reports whether OIDC is configured at all. Then it must be valid.
+func (c OIDCConfig) Enabled() bool {
+	return c.Issuer != "" || c.ClientID != "" || c.RedirectURL != ""
+}
+
+func (c OIDCConfig) validate() error {
+	var problems []string
+	if c.Enabled() {
+		if u, err := url.Parse(c.Issuer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, "OIDC_ISSUER must be an http(s) URL, got "+fmt.Sprintf("%q", c.Issuer))
+		}
+		if c.ClientID == "" {
+			problems = append(problems, "OIDC_CLIENT_ID is missing")
+		}
+		if u, err := url.Parse(c.RedirectURL); err != nil || !u.IsAbs() || u.Host == "" {
+			problems = append(problems, "OIDC_REDIRECT_URL must be an absolute URL, got "+fmt.Sprintf("%q", c.RedirectURL))
+		}
+		if c.SessionKey == "" {
+			problems = append(problems, "SESSION_KEY is missing, logins must survive restarts")
+		}
+	}
+	if c.SessionKey != "" && len(c.SessionKey) < minSessionKeyLen {
+		problems = append(problems, fmt.Sprintf("SESSION_KEY must be at least %d bytes, got %d", minSessionKeyLen, len(c.SessionKey)))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid OIDC configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// readSecretFile reads KEY=VALUE lines, with the env var names as keys.
+// Empty lines and lines starting with # are skipped.
+func readSecretFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return values, scanner.Err()
+}
+
+// loadOIDCConfig reads the secret file (OIDC_SECRET_FILE or
+// -oidc-secret-file), then the env vars, then the flags in args.
+func loadOIDCConfig(args []string) (OIDCConfig, error) {
+	var cfg OIDCConfig
+	fs := flag.NewFlagSet("gosrv", flag.ExitOnError)
+	secretFile := fs.String("oidc-secret-file", os.Getenv("OIDC_SECRET_FILE"), "file with KEY=VALUE lines for the settings below, keyed by their env var names")
+	flagValues := map[string]*string{}
+	for _, s := range oidcSettings {
+		flagValues[s.flag] = fs.String(s.flag, "", s.usage+" (env "+s.env+")")
+	}
+	fs.Parse(args)
+
+	if *secretFile != "" {
+		values, err := readSecretFile(*secretFile)
+		if err != nil {
+			return cfg, fmt.Errorf("reading the OIDC secret file: %w", err)
+		}
+		for _, s := range oidcSettings {
+			if v, ok := values[s.env]; ok {
+				*s.field(&cfg) = v
+			}
+		}
+	}
+	for _, s := range oidcSettings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			*s.field(&cfg) = v
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range oidcSettings {
+			if s.flag == f.Name {
+				*s.field(&cfg) = *flagValues[s.flag]
+			}
+		}
+	})
+	return cfg, cfg.validate()
+}
+
+// secureCookies reports whether the cookies are served over HTTPS only:
+// SECURE_COOKIES=on, or by default when the redirect URL is https.
+func (c OIDCConfig) secureCookies() bool {
+	if v, ok := os.LookupEnv("SECURE_COOKIES"); ok {
+		return v == "on"
+	}
+	return strings.HasPrefix(c.RedirectURL, "https://")
+}
+
+// setupSessions creates the cookie store. Without a key the sessions are
+// signed with a random one, and end when the server restarts.
+func setupSessions(cfg OIDCConfig) {
+	key := cfg.SessionKey
+	if key == "" {
+		fmt.Println("SESSION_KEY not set, using a random one: sessions end on restart")
+		b := make([]byte, minSessionKeyLen)
+		rand.Read(b)
+		key = string(b)
+	}
+	store = sessions.NewCookieStore([]byte(key))
+	// the defaults are Secure and SameSite=None, over plain HTTP the
+	// browser would never send the cookies back
+	store.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   86400 * 30,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   cfg.secureCookies(),
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+)
+
+// echoHandler only reflects into an HTML body. These endpoints reflect q
+// into the other positions of a page, each once with fmt.Fprintf, which is
+// vulnerable, and once with html/template, which escapes for the context
+// it finds the value in.
+
+type ReflectContext struct {
+	Name    string
+	Title   string
+	Payload string // breaks out of the vulnerable version
+	Note    string // what html/template does instead
+	// Vulnerable is a format string, %[1]s is q and %[2]s the CSP nonce.
+	// The safe version is the template of the same name in reflect-safe.html.
+	Vulnerable string
+}
+
+var reflectContexts = []ReflectContext{
+	{
+		Name:       "attr",
+		Title:      "HTML attribute",
+		Payload:    `"><img src=x onerror="alert(document.domain)">`,
+		Note:       `escapes the quote to &#34;, so the value can't close the attribute`,
+		Vulnerable: `<input value="%[1]s" size="60">`,
+	},
+	{
+		Name:       "unquoted",
+		Title:      "Unquoted attribute",
+		Payload:    `x autofocus onfocus=alert(document.domain)`,
+		Note:       `escapes spaces too, so the value can't start a new attribute`,
+		Vulnerable: `<input value=%[1]s size=60>`,
+	},
+	{
+		Name:       "js",
+		Title:      "JavaScript string",
+		Payload:    `';alert(document.domain);//`,
+		Note:       `writes a quoted JS string and escapes quotes and < inside it, a nonce can't tell injected code from ours`,
+		Vulnerable: `<p id="out"></p><script nonce="%[2]s">var q = '%[1]s'; document.getElementById("out").textContent = q;</script>`,
+	},
+	{
+		Name:       "url",
+		Title:      "URL in href",
+		Payload:    `javascript:alert(document.domain)`,
+		Note:       `only allows http, https and mailto URLs, anything else becomes #ZgotmplZ`,
+		Vulnerable: `<a href="%[1]s">Click me</a>`,
+	},
+	{
+		Name:       "css",
+		Title:      "CSS value",
+		Payload:    `red; background: url(https://upload.wikimedia.org/wikipedia/commons/thumb/3/31/Netherlandwarf.jpg/500px-Netherlandwarf.jpg)`,
+		Note:       `rejects values that aren't a plain CSS value, they become ZgotmplZ`,
+		Vulnerable: `<div style="color: %[1]s; padding: 1em">Styled by you</div>`,
+	},
+	{
+		Name:       "json",
+		Title:      "JSON in a script",
+		Payload:    `</script><script>alert(document.domain)</script>`,
+		Note:       `encodes the data as JSON and escapes <, so </script> can't end the script early`,
+		Vulnerable: `<p id="out"></p><script nonce="%[2]s">var data = %[1]s; document.getElementById("out").textContent = data.q;</script>`,
+	},
+}
+
+func findReflectContext(name string) (ReflectContext, bool) {
+	for _, c := range reflectContexts {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return ReflectContext{}, false
+}
+
+// jsonUnescaped marshals v like many handlers do before pasting it into a
+// script: without escaping <, > and &.
+func jsonUnescaped(v any) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+	return string(bytes.TrimSpace(buf.Bytes()))
+}
+
+func reflectPageHandler(w http.ResponseWriter, r *http.Request) {
+	templatePath := filepath.Join("templates", "reflect.html")
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, reflectContexts)
+}
+
+func writeReflectHeader(w http.ResponseWriter, c ReflectContext, variant string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%s (%s)</title>\n<h1>%s, %s</h1>\n<p><a href=\"/reflect\">back</a></p>\n", c.Title, variant, c.Title, variant)
+}
+
+func reflectVulnerableHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := findReflectContext(r.PathValue("context"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query().Get("q")
+	if c.Name == "json" {
+		q = jsonUnescaped(map[string]string{"q": q})
+	}
+	writeReflectHeader(w, c, "vulnerable")
+	// ⚠️ INTENTIONALLY VULNERABLE
+	fmt.Fprintf(w, c.Vulnerable, q, cspNonce(r))
+}
+
+func reflectSafeHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := findReflectContext(r.PathValue("context"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	templatePath := filepath.Join("templates", "reflect-safe.html")
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query().Get("q")
+	writeReflectHeader(w, c, "safe")
+	err = tmpl.ExecuteTemplate(w, c.Name, struct {
+		Q     string
+		Data  map[string]string
+		Nonce string
+	}{q, map[string]string{"q": q}, cspNonce(r)})
+	if err != nil {
+		fmt.Println("render error:", err)
+	}
+}
+
+func setupReflect(mux *http.ServeMux) {
+	mux.HandleFunc("GET /reflect", reflectPageHandler)
+	// served under the CSP lab's policy, like the rest of the XSS lab
+	mux.Handle("GET /reflect/{context}/vulnerable", cspDecorator(http.HandlerFunc(reflectVulnerableHandler)))
+	mux.Handle("GET /reflect/{context}/safe", cspDecorator(http.HandlerFunc(reflectSafeHandler)))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The probe sleeps for a fixed interval over and over and records how late it
+// wakes up. Unlike the cumulative /sched/latencies histogram this directly
+// shows what oversubscribing with cpuBurner workers does to everyone else.
+
+const (
+	probeInterval = 5 * time.Millisecond
+	probeWindow   = 2000 // samples, ~10s at probeInterval
+)
+
+var probeBuckets = []time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+var (
+	probeMu      sync.Mutex
+	probeSamples = make([]time.Duration, 0, probeWindow)
+	probeNext    int // ring buffer write position once full
+)
+
+type ProbeStats struct {
+	Interval  time.Duration
+	Samples   int
+	P50       time.Duration
+	P90       time.Duration
+	P99       time.Duration
+	Max       time.Duration
+	Histogram []BenchBucket
+}
+
+func recordProbe(lateness time.Duration) {
+	probeMu.Lock()
+	defer probeMu.Unlock()
+	if len(probeSamples) < probeWindow {
+		probeSamples = append(probeSamples, lateness)
+		return
+	}
+	probeSamples[probeNext] = lateness
+	probeNext = (probeNext + 1) % probeWindow
+}
+
+func runSchedProbe() {
+	for {
+		start := time.Now()
+		time.Sleep(probeInterval)
+		recordProbe(max(time.Since(start)-probeInterval, 0))
+	}
+}
+
+func probeStats() ProbeStats {
+	probeMu.Lock()
+	samples := slices.Clone(probeSamples)
+	probeMu.Unlock()
+
+	stats := ProbeStats{Interval: probeInterval, Samples: len(samples)}
+	if len(samples) == 0 {
+		return stats
+	}
+	slices.Sort(samples)
+	stats.P50, stats.P90, stats.P99 = percentile(samples, 0.50), percentile(samples, 0.90), percentile(samples, 0.99)
+	stats.Max = samples[len(samples)-1]
+	stats.Histogram = latencyHistogram(samples, probeBuckets)
+	return stats
+}
+
+func schedProbeHandler(w http.ResponseWriter, r *http.Request) {
+	templatePath := filepath.Join("templates", "sched-probe.html")
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, probeStats())
+}
@@ -0,0 +1,9 @@
+// Shared htmx settings, load it right after htmx itself.
+
+// swap 422 responses too, they carry the form with the validation errors
+htmx.config.responseHandling = [
+  {code: "204", swap: false},
+  {code: "[23]..", swap: true},
+  {code: "422", swap: true},
+  {code: "[45]..", swap: false, error: true},
+];
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// The access and refresh tokens of a login never leave the server: the
+// session cookie only holds a random id for them. An oauth2.TokenSource
+// refreshes the access token when it's about to expire, whenever it's used.
+
+const maxRefreshHistory = 20
+
+// refresh this long before the access token expires
+var tokenRefreshEarly = envDuration("TOKEN_REFRESH_EARLY", 10*time.Second)
+
+var errNoTokens = errors.New("no tokens for this session, log in again")
+
+// TokenRefresh is one trip to the token endpoint.
+type TokenRefresh struct {
+	At        time.Time
+	OldExpiry time.Time
+	NewExpiry time.Time
+	Err       string
+}
+
+// UserTokens are the tokens of one login.
+type UserTokens struct {
+	mu         sync.Mutex
+	source     oauth2.TokenSource
+	rawIDToken string         // the latest, refreshes may send a new one
+	Refreshes  []TokenRefresh // newest first
+	expiresAt  time.Time      // when the login's session ends, set on save
+}
+
+// recordingTokenSource refreshes through the provider and records each
+// refresh. The ReuseTokenSource around it only calls it when needed.
+type recordingTokenSource struct {
+	tokens *UserTokens
+	token  *oauth2.Token // the one to refresh
+}
+
+func (s *recordingTokenSource) Token() (*oauth2.Token, error) {
+	t, err := oauth2Config.TokenSource(ctx, &oauth2.Token{RefreshToken: s.token.RefreshToken}).Token()
+	refresh := TokenRefresh{At: time.Now(), OldExpiry: s.token.Expiry}
+	if err != nil {
+		refresh.Err = err.Error()
+		fmt.Println("token refresh failed:", err)
+	} else {
+		refresh.NewExpiry = t.Expiry
+		s.token = t
+		if raw, ok := t.Extra("id_token").(string); ok {
+			s.tokens.rawIDToken = raw
+		}
+	}
+	s.tokens.Refreshes = slices.Insert(s.tokens.Refreshes, 0, refresh)
+	if len(s.tokens.Refreshes) > maxRefreshHistory {
+		s.tokens.Refreshes = s.tokens.Refreshes[:maxRefreshHistory]
+	}
+	return t, err
+}
+
+func newUserTokens(t *oauth2.Token, rawIDToken string) *UserTokens {
+	ut := &UserTokens{rawIDToken: rawIDToken}
+	ut.source = oauth2.ReuseTokenSourceWithExpiry(t, &recordingTokenSource{tokens: ut, token: t}, tokenRefreshEarly)
+	return ut
+}
+
+// Token returns a valid access token, refreshing it first if needed.
+// Caller must not hold ut.mu.
+func (ut *UserTokens) Token() (*oauth2.Token, error) {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	return ut.source.Token()
+}
+
+// ForceRefresh refreshes now, however long the access token has left.
+func (ut *UserTokens) ForceRefresh() error {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	current, err := ut.source.Token()
+	if err != nil {
+		return err
+	}
+	// the history gets the real expiry, only the cache sees it as expired
+	previous, expired := *current, *current
+	expired.Expiry = time.Now().Add(-time.Second)
+	ut.source = oauth2.ReuseTokenSourceWithExpiry(&expired, &recordingTokenSource{tokens: ut, token: &previous}, tokenRefreshEarly)
+	_, err = ut.source.Token()
+	return err
+}
+
+var (
+	userTokensMu sync.Mutex
+	userTokens   = map[string]*UserTokens{} // by session id
+)
+
+// saveUserTokens keeps the tokens as long as the session lasts. Sessions
+// that just expire never log out, so saving also drops their tokens.
+func saveUserTokens(sid string, ut *UserTokens) {
+	ut.expiresAt = time.Now().Add(sessionMaxAge)
+	userTokensMu.Lock()
+	defer userTokensMu.Unlock()
+	for id, old := range userTokens {
+		if time.Now().After(old.expiresAt) {
+			delete(userTokens, id)
+		}
+	}
+	userTokens[sid] = ut
+}
+
+func deleteUserTokens(sid string) {
+	userTokensMu.Lock()
+	defer userTokensMu.Unlock()
+	delete(userTokens, sid)
+}
+
+// tokensFromRequest looks up the tokens of the request's session. They are
+// gone after a restart, the session cookie may outlive them.
+func tokensFromRequest(r *http.Request) (*UserTokens, error) {
+	session, _ := store.Get(r, "auth")
+	sid, _ := session.Values["sid"].(string)
+	userTokensMu.Lock()
+	defer userTokensMu.Unlock()
+	ut, ok := userTokens[sid]
+	if !ok {
+		return nil, errNoTokens
+	}
+	if time.Now().After(ut.expiresAt) {
+		delete(userTokens, sid)
+		return nil, errNoTokens
+	}
+	return ut, nil
+}
+
+// JWTView is a decoded JWT. The signature isn't checked, it's for looking only.
+type JWTView struct {
+	Claims    string // indented JSON
+	Expiry    time.Time
+	ExpiresIn time.Duration
+}
+
+func decodeJWT(raw string) (JWTView, bool) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return JWTView{}, false // opaque, not every provider uses JWTs
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return JWTView{}, false
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, payload, "", "  "); err != nil {
+		return JWTView{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	json.Unmarshal(payload, &claims)
+	v := JWTView{Claims: indented.String()}
+	if claims.Exp != 0 {
+		v.Expiry = time.Unix(claims.Exp, 0)
+		v.ExpiresIn = time.Until(v.Expiry).Round(time.Second)
+	}
+	return v, true
+}
+
+type AuthDebugView struct {
+	User             SessionUser
+	SessionExpiresIn time.Duration
+	Error            string
+	IDToken          JWTView
+	AccessToken      JWTView
+	AccessOpaque     bool
+	AccessExpiresIn  time.Duration
+	HasRefreshToken  bool
+	RefreshEarly     time.Duration
+	Refreshes        []TokenRefresh
+	CSRFToken        string
+}
+
+// authDebugView gets the access token through the TokenSource, so just
+// looking at the page refreshes it when it's due.
+func authDebugView(r *http.Request) AuthDebugView {
+	user, _ := currentUser(r)
+	v := AuthDebugView{
+		User:             user,
+		SessionExpiresIn: time.Until(user.ExpiresAt).Round(time.Second),
+		RefreshEarly:     tokenRefreshEarly,
+	}
+	ut, err := tokensFromRequest(r)
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+	t, err := ut.Token()
+	if err != nil {
+		v.Error = "refreshing failed: " + err.Error()
+	}
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	v.IDToken, _ = decodeJWT(ut.rawIDToken)
+	v.Refreshes = slices.Clone(ut.Refreshes)
+	if t != nil {
+		var ok bool
+		v.AccessToken, ok = decodeJWT(t.AccessToken)
+		v.AccessOpaque = !ok
+		v.AccessExpiresIn = time.Until(t.Expiry).Round(time.Second)
+		v.HasRefreshToken = t.RefreshToken != ""
+	}
+	return v
+}
+
+func authDebugHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := currentUser(r); !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	templatePath := filepath.Join("templates", "auth-debug.html")
+	tmpl, err := template.ParseFiles(templatePath, filepath.Join("templates", "auth-debug-tokens.html"))
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	v := authDebugView(r)
+	v.CSRFToken = csrfToken(w, r)
+	tmpl.Execute(w, v)
+}
+
+func authDebugTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := currentUser(r); !ok {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+	templatePath := filepath.Join("templates", "auth-debug-tokens.html")
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, authDebugView(r))
+}
+
+func authDebugRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	ut, err := tokensFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := ut.ForceRefresh(); err != nil {
+		http.Error(w, "refresh failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	authDebugTokensHandler(w, r)
+}
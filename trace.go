@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Execution traces are the only way to actually see how the cpuBurner
+// goroutines get spread over the Ps when GOMAXPROCS is changed. Open a
+// downloaded file with:
+//
+//	go tool trace <file>.trace
+var (
+	traceMu      sync.Mutex
+	traceFile    *os.File // non-nil while a capture is running
+	traceStarted time.Time
+	traceTimer   *time.Timer // set for timed captures
+
+	// container runs as USER 1001, so default to somewhere writable
+	traceDir = envOr("TRACE_DIR", filepath.Join(os.TempDir(), "gosrv-traces"))
+)
+
+const maxTraceSeconds = 60
+
+type TraceInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+// startTrace begins writing an execution trace to a new file in traceDir.
+// Caller must hold traceMu.
+func startTrace() (string, error) {
+	if traceFile != nil {
+		return "", fmt.Errorf("trace %s already running since %s", filepath.Base(traceFile.Name()), traceStarted.Format(time.TimeOnly))
+	}
+	if err := os.MkdirAll(traceDir, 0o755); err != nil {
+		return "", err
+	}
+	name := "gosrv-" + time.Now().Format("20060102-150405.000") + ".trace"
+	f, err := os.Create(filepath.Join(traceDir, name))
+	if err != nil {
+		return "", err
+	}
+	if err := trace.Start(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	traceFile = f
+	traceStarted = time.Now()
+	return name, nil
+}
+
+// stopTrace ends the running capture and returns the name of the written file.
+// Caller must hold traceMu.
+func stopTrace() (string, error) {
+	if traceFile == nil {
+		return "", fmt.Errorf("no trace running")
+	}
+	if traceTimer != nil {
+		traceTimer.Stop()
+		traceTimer = nil
+	}
+	trace.Stop()
+	name := filepath.Base(traceFile.Name())
+	err := traceFile.Close()
+	traceFile = nil
+	return name, err
+}
+
+func listTraces() ([]TraceInfo, error) {
+	entries, err := os.ReadDir(traceDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var traces []TraceInfo
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".trace" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		traces = append(traces, TraceInfo{Name: e.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	// newest first
+	sort.Slice(traces, func(i, j int) bool { return traces[i].ModTime.After(traces[j].ModTime) })
+	return traces, nil
+}
+
+func traceStartHandler(w http.ResponseWriter, r *http.Request) {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+
+	name, err := startTrace()
+	if err != nil {
+		http.Error(w, "couldn't start trace: "+err.Error(), http.StatusConflict)
+		return
+	}
+	fmt.Println("trace started:", name)
+	w.Header().Set("HX-Trigger", "tracesChanged")
+	fmt.Fprintf(w, "Started execution trace %s\n", name)
+}
+
+func traceStopHandler(w http.ResponseWriter, r *http.Request) {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+
+	name, err := stopTrace()
+	if err != nil {
+		http.Error(w, "couldn't stop trace: "+err.Error(), http.StatusConflict)
+		return
+	}
+	fmt.Println("trace stopped:", name)
+	w.Header().Set("HX-Trigger", "tracesChanged")
+	fmt.Fprintf(w, "Stopped execution trace, saved %s\n", name)
+}
+
+// traceCaptureHandler records a trace for ?seconds=N (default 5) and stops it
+// in the background, so the request returns right away.
+func traceCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	seconds := 5
+	if s := r.FormValue("seconds"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxTraceSeconds {
+			http.Error(w, fmt.Sprintf("seconds must be between 1 and %d", maxTraceSeconds), http.StatusBadRequest)
+			return
+		}
+		seconds = n
+	}
+
+	traceMu.Lock()
+	defer traceMu.Unlock()
+
+	name, err := startTrace()
+	if err != nil {
+		http.Error(w, "couldn't start trace: "+err.Error(), http.StatusConflict)
+		return
+	}
+	traceTimer = time.AfterFunc(time.Duration(seconds)*time.Second, func() {
+		traceMu.Lock()
+		defer traceMu.Unlock()
+		// a manual stop may have beaten us to it
+		if traceFile == nil || filepath.Base(traceFile.Name()) != name {
+			return
+		}
+		traceTimer = nil
+		if _, err := stopTrace(); err != nil {
+			fmt.Println("timed trace stop failed:", err)
+			return
+		}
+		fmt.Println("timed trace finished:", name)
+	})
+	fmt.Println("timed trace started:", name, "seconds:", seconds)
+	w.Header().Set("HX-Trigger", "tracesChanged")
+	fmt.Fprintf(w, "Capturing %ds execution trace to %s\n", seconds, name)
+}
+
+func traceListHandler(w http.ResponseWriter, r *http.Request) {
+	traces, err := listTraces()
+	if err != nil {
+		http.Error(w, "couldn't list traces: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	traceMu.Lock()
+	var running string
+	if traceFile != nil {
+		running = filepath.Base(traceFile.Name())
+	}
+	traceMu.Unlock()
+
+	data := struct {
+		Running string
+		Traces  []TraceInfo
+	}{running, traces}
+
+	templatePath := filepath.Join("templates", "trace-list.html")
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, data)
+}
+
+func setupTrace(mux *http.ServeMux) {
+	// POST only, they change server state and an <img> mustn't trigger them
+	mux.HandleFunc("POST /debug/trace/start", traceStartHandler)
+	mux.HandleFunc("POST /debug/trace/stop", traceStopHandler)
+	mux.HandleFunc("POST /debug/trace/capture", traceCaptureHandler)
+	mux.HandleFunc("/debug/trace/list", traceListHandler)
+	// download stored traces
+	mux.Handle("/debug/traces/", http.StripPrefix("/debug/traces/", http.FileServer(http.Dir(traceDir))))
+}
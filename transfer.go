@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"math/rand/v2"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxStressAccounts  = 1000
+	maxStressTransfers = 1_000_000
+	maxStressWorkers   = 1000
+	stressBalance      = 1000
+)
+
+// transferHandler moves the form's amount from one account to another and
+// renders the source account.
+func transferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	from, err1 := strconv.Atoi(r.FormValue("from"))
+	to, err2 := strconv.Atoi(r.FormValue("to"))
+	if err1 != nil || err2 != nil {
+		http.Error(w, "from and to must be account numbers", http.StatusBadRequest)
+		return
+	}
+	amount, err := strconv.Atoi(r.FormValue("amount"))
+	if err != nil || amount < 1 || amount > maxAmount {
+		http.Error(w, fmt.Sprintf("amount must be between 1 and %d", maxAmount), http.StatusBadRequest)
+		return
+	}
+
+	version, ok := ifMatchVersion(w, r)
+	if !ok {
+		return
+	}
+
+	a, err := accounts.Transfer(from, to, amount, version, actorFromRequest(r), false)
+	switch {
+	case errors.Is(err, errVersionMismatch):
+		renderAccountStatus(w, r, a, http.StatusPreconditionFailed)
+		return
+	case errors.Is(err, errAccountNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errOverdraft):
+		renderOverdraft(w, a, amount)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	renderAccount(w, r, a)
+}
+
+type StressResult struct {
+	Unsafe        bool
+	Accounts      int
+	Transfers     int
+	Workers       int
+	Refused       int // transfers refused for insufficient funds
+	ExpectedTotal int
+	ActualTotal   int
+	Elapsed       time.Duration
+}
+
+func (res StressResult) Conserved() bool { return res.ExpectedTotal == res.ActualTotal }
+
+// runTransferStress fires random transfers between throwaway accounts from
+// many goroutines and checks that no money appeared or vanished.
+func runTransferStress(numAccounts, transfers, workers int, unsafe bool) StressResult {
+	store, _ := NewAccountStore("")
+	store.noLedger = true
+	for i := range numAccounts {
+		store.Create(i+1, stressBalance)
+	}
+	res := StressResult{
+		Unsafe:        unsafe,
+		Accounts:      numAccounts,
+		Transfers:     transfers,
+		Workers:       workers,
+		ExpectedTotal: store.Total(),
+	}
+
+	jobs := make(chan struct{})
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		refused int
+	)
+	start := time.Now()
+	for range workers {
+		wg.Go(func() {
+			for range jobs {
+				from := rand.IntN(numAccounts) + 1
+				to := rand.IntN(numAccounts-1) + 1
+				if to >= from {
+					to++
+				}
+				if _, err := store.Transfer(from, to, rand.IntN(10)+1, anyVersion, "stress", unsafe); err != nil {
+					mu.Lock()
+					refused++
+					mu.Unlock()
+				}
+			}
+		})
+	}
+	for range transfers {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+
+	res.Elapsed = time.Since(start)
+	res.Refused = refused
+	res.ActualTotal = store.Total()
+	return res
+}
+
+// transferStressHandler runs the stress test, with ?unsafe=on without locks.
+func transferStressHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	formInt := func(name string, fallback, limit int) (int, bool) {
+		v := r.FormValue(name)
+		if v == "" {
+			return fallback, true
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > limit {
+			http.Error(w, fmt.Sprintf("%s must be between 1 and %d", name, limit), http.StatusBadRequest)
+			return 0, false
+		}
+		return n, true
+	}
+	numAccounts, ok := formInt("accounts", 10, maxStressAccounts)
+	if !ok {
+		return
+	}
+	if numAccounts < 2 {
+		http.Error(w, "accounts must be at least 2", http.StatusBadRequest)
+		return
+	}
+	transfers, ok := formInt("transfers", 10000, maxStressTransfers)
+	if !ok {
+		return
+	}
+	workers, ok := formInt("workers", 50, maxStressWorkers)
+	if !ok {
+		return
+	}
+	unsafe := r.FormValue("unsafe") != ""
+
+	res := runTransferStress(numAccounts, transfers, workers, unsafe)
+	fmt.Printf("transfer stress: unsafe=%t expected=%d actual=%d elapsed=%s\n", unsafe, res.ExpectedTotal, res.ActualTotal, res.Elapsed)
+
+	templatePath := filepath.Join("templates", "transfer-stress.html")
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		http.Error(w, "template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, res)
+}
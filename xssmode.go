@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// The stored XSS lab can render the same stored comments in different modes,
+// so a payload can be shown executing, escaped and sanitized side by side.
+const (
+	commentModeRaw       = "raw"       // template.HTML, the payload executes
+	commentModeEscaped   = "escaped"   // plain string, html/template escapes it
+	commentModeSanitized = "sanitized" // only allowlisted HTML survives
+	commentModeCompare   = "compare"   // all of the above next to each other
+)
+
+var commentModes = []string{commentModeRaw, commentModeEscaped, commentModeSanitized, commentModeCompare}
+
+// Rendering is a comment's content as one mode produced it. Content is a
+// template.HTML for raw and sanitized, and a string for escaped, which is
+// exactly what decides whether html/template escapes it.
+type Rendering struct {
+	Mode    string
+	Content any
+}
+
+type RenderedComment struct {
+	Comment
+	Renderings []Rendering
+}
+
+func renderComment(c Comment, mode string) Rendering {
+	switch mode {
+	case commentModeEscaped:
+		return Rendering{mode, c.Content}
+	case commentModeSanitized:
+		return Rendering{mode, sanitizeHTML(c.Content)}
+	}
+	return Rendering{commentModeRaw, template.HTML(c.Content)}
+}
+
+func renderComments(list []Comment, mode string) []RenderedComment {
+	modes := []string{mode}
+	if mode == commentModeCompare {
+		modes = []string{commentModeRaw, commentModeEscaped, commentModeSanitized}
+	}
+	rendered := make([]RenderedComment, 0, len(list))
+	for _, c := range list {
+		rc := RenderedComment{Comment: c}
+		for _, m := range modes {
+			rc.Renderings = append(rc.Renderings, renderComment(c, m))
+		}
+		rendered = append(rendered, rc)
+	}
+	return rendered
+}
+
+// commentMode picks the mode from ?mode=, else from the session, else raw,
+// which is how the lab always behaved.
+func commentMode(r *http.Request) string {
+	if mode := r.URL.Query().Get("mode"); slices.Contains(commentModes, mode) {
+		return mode
+	}
+	session, _ := store.Get(r, "xss-lab")
+	if mode, ok := session.Values["commentMode"].(string); ok && slices.Contains(commentModes, mode) {
+		return mode
+	}
+	return commentModeRaw
+}
+
+// commentModeHandler stores the chosen mode in the session.
+func commentModeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mode := r.FormValue("mode")
+	if !slices.Contains(commentModes, mode) {
+		http.Error(w, "unknown mode", http.StatusBadRequest)
+		return
+	}
+	session, _ := store.Get(r, "xss-lab")
+	session.Values["commentMode"] = mode
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, "couldn't save session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("HX-Trigger", "commentsUpdate")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The sanitizer tokenizes the comment and only lets a small allowlist of
+// tags through as markup. Anything else, like attributes on <b> or an
+// onerror on <img>, stays visible as escaped text. Links and images only
+// keep an http(s) URL and nothing else. Tags a comment leaves open are
+// closed at its end, so they can't bleed into the rest of the page.
+var allowedTags = []string{"b", "i", "em", "strong", "u", "code", "p", "ul", "ol", "li", "blockquote", "a"}
+
+// allowedURL reports whether the only attribute is an http(s) URL in key.
+func allowedURL(attrs []html.Attribute, key string) (string, bool) {
+	if len(attrs) != 1 || attrs[0].Key != key {
+		return "", false
+	}
+	u, err := url.Parse(attrs[0].Val)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	return u.String(), true
+}
+
+func sanitizeHTML(content string) template.HTML {
+	var b strings.Builder
+	var open []string // allowed tags not closed yet, innermost last
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break // io.EOF, the tokenizer is lenient about everything else
+		}
+		raw := string(z.Raw())
+		t := z.Token()
+		switch {
+		case tt == html.TextToken:
+			b.WriteString(template.HTMLEscapeString(t.Data))
+		case t.Data == "br" && len(t.Attr) == 0 && tt != html.EndTagToken:
+			b.WriteString("<br>")
+		case t.Data == "img" && tt != html.EndTagToken:
+			src, ok := allowedURL(t.Attr, "src")
+			if !ok {
+				b.WriteString(template.HTMLEscapeString(raw))
+				break
+			}
+			fmt.Fprintf(&b, `<img src="%s" style="max-width: 200px">`, template.HTMLEscapeString(src))
+		case tt == html.StartTagToken && slices.Contains(allowedTags, t.Data):
+			if t.Data == "a" {
+				href, ok := allowedURL(t.Attr, "href")
+				if !ok {
+					b.WriteString(template.HTMLEscapeString(raw))
+					break
+				}
+				fmt.Fprintf(&b, `<a href="%s" rel="nofollow noopener">`, template.HTMLEscapeString(href))
+			} else if len(t.Attr) > 0 {
+				b.WriteString(template.HTMLEscapeString(raw))
+				break
+			} else {
+				b.WriteString("<" + t.Data + ">")
+			}
+			open = append(open, t.Data)
+		case tt == html.EndTagToken && slices.Contains(allowedTags, t.Data):
+			// close everything opened inside it too, a stray closer is dropped
+			i := len(open) - 1
+			for i >= 0 && open[i] != t.Data {
+				i--
+			}
+			if i >= 0 {
+				for j := len(open) - 1; j >= i; j-- {
+					b.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+			}
+		default:
+			b.WriteString(template.HTMLEscapeString(raw))
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + open[i] + ">")
+	}
+	return template.HTML(b.String())
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"text", "hello & <world>", "hello &amp; &lt;world&gt;"},
+		{"allowed tags", "<b>bold</b> <em>em</em><br>", "<b>bold</b> <em>em</em><br>"},
+		{"script", "<script>alert(1)</script>", "&lt;script&gt;alert(1)&lt;/script&gt;"},
+		{"onerror", `<img src=x onerror=alert(1)>`, "&lt;img src=x onerror=alert(1)&gt;"},
+		{"attributes on allowed tag", `<b onclick="x()">hi</b>`, "&lt;b onclick=&#34;x()&#34;&gt;hi"},
+		{"link", `<a href="https://example.com/?a=1&b=2">x</a>`, `<a href="https://example.com/?a=1&amp;b=2" rel="nofollow noopener">x</a>`},
+		{"javascript link", `<a href="javascript:alert(1)">x</a>`, "&lt;a href=&#34;javascript:alert(1)&#34;&gt;x"},
+		{"quote in the URL", `<a href='https://e.com/"onmouseover="x'>x</a>`, `<a href="https://e.com/%22onmouseover=%22x" rel="nofollow noopener">x</a>`},
+		{"image", `<img src="https://e.com/cat.png">`, `<img src="https://e.com/cat.png" style="max-width: 200px">`},
+		{"unclosed b", "<b>bold", "<b>bold</b>"},
+		{"unclosed link", `<a href="https://e.com">x`, `<a href="https://e.com" rel="nofollow noopener">x</a>`},
+		{"unclosed nesting", "<blockquote><ul><li>a", "<blockquote><ul><li>a</li></ul></blockquote>"},
+		{"closer closes inner tags", "<b><i>x</b>y", "<b><i>x</i></b>y"},
+		{"stray closer", "</b></blockquote>x", "x"},
+		{"closing the page", "</div></body>x", "&lt;/div&gt;&lt;/body&gt;x"},
+		{"self-closing", "<b/>x<br/>", "&lt;b/&gt;x<br>"},
+		{"comment", "<!-- x -->", "&lt;!-- x --&gt;"},
+	}
+	for _, tt := range tests {
+		if got := string(sanitizeHTML(tt.in)); got != tt.want {
+			t.Errorf("%s: sanitizeHTML(%q)\n got %q\nwant %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}